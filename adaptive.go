@@ -0,0 +1,461 @@
+package bigbitvector
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// chunkOverhead approximates the bookkeeping cost of one resident chunk.
+const chunkOverhead = 64
+
+type adaptiveChunk struct {
+	c     container
+	stamp uint64
+	sz    uint64
+	pins  uint32
+	dirty bool
+}
+
+type adaptiveArray struct {
+	chunks map[uint64]*adaptiveChunk
+	spill  spillStore
+	buf    []byte
+	mem    uint64
+	limit  uint64
+	clock  uint64
+	num    uint64
+	ro     bool
+}
+
+func newAdaptiveArray(num, limit uint64, ro bool) *adaptiveArray {
+	return &adaptiveArray{
+		chunks: make(map[uint64]*adaptiveChunk),
+		spill:  newSpillStore(),
+		limit:  limit,
+		num:    num,
+		ro:     ro,
+	}
+}
+
+func (bv *adaptiveArray) Frozen() bool {
+	return bv.ro
+}
+
+func (bv *adaptiveArray) Len() uint64 {
+	return bv.num
+}
+
+func (bv *adaptiveArray) BitAt(index uint64) (bool, error) {
+	if index >= bv.Len() {
+		return false, io.EOF
+	}
+	ch, err := bv.chunk(index/chunkBits, false)
+	if err != nil || ch == nil || ch.c == nil {
+		return false, err
+	}
+	return ch.c.get(uint16(index % chunkBits)), nil
+}
+
+func (bv *adaptiveArray) SetBitAt(index uint64, bit bool) error {
+	if bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if index >= bv.Len() {
+		return io.EOF
+	}
+	ci := index / chunkBits
+	ch, err := bv.chunk(ci, bit)
+	if err != nil || ch == nil {
+		return err
+	}
+	bv.update(ci, ch, uint16(index%chunkBits), bit)
+	return bv.evict()
+}
+
+func (bv *adaptiveArray) Iterate(i, j uint64) Iterator {
+	if i > j {
+		panic(fmt.Errorf("adaptiveArray.Iterate: i > j: i=%d j=%d", i, j))
+	}
+	return &adaptiveIterator{
+		bv:   bv,
+		base: i,
+		num:  (j - i),
+	}
+}
+
+func (bv *adaptiveArray) ReverseIterate(i, j uint64) Iterator {
+	if i > j {
+		panic(fmt.Errorf("adaptiveArray.ReverseIterate: i > j: i=%d j=%d", i, j))
+	}
+	return &adaptiveIterator{
+		bv:   bv,
+		base: i,
+		num:  (j - i),
+		down: true,
+	}
+}
+
+func (bv *adaptiveArray) CopyFrom(src BigBitVector) error {
+	if bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if src.Len() != bv.Len() {
+		panic("bit arrays are not equal in size")
+	}
+	return copyFromImpl(bv, src)
+}
+
+func (bv *adaptiveArray) Truncate(n uint64) error {
+	if bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if n > bv.Len() {
+		panic("cannot grow a bit array")
+	}
+	for _, ch := range bv.chunks {
+		if ch.pins != 0 {
+			panic("Truncate() with live iterators is undefined behavior")
+		}
+	}
+
+	numChunks := (n + chunkBits - 1) / chunkBits
+	for ci, ch := range bv.chunks {
+		if ci >= numChunks {
+			bv.drop(ci, ch)
+		}
+	}
+	for ci := range bv.spill.index {
+		if ci >= numChunks {
+			bv.spill.remove(ci)
+		}
+	}
+
+	if r := n % chunkBits; r != 0 {
+		ci := n / chunkBits
+		ch, err := bv.chunk(ci, false)
+		if err != nil {
+			return err
+		}
+		for x := r; ch != nil && ch.c != nil && x < chunkBits; x++ {
+			bv.update(ci, ch, uint16(x), false)
+		}
+	}
+	bv.num = n
+	return nil
+}
+
+func (bv *adaptiveArray) Freeze() error {
+	bv.ro = true
+	return nil
+}
+
+// Flush converts every resident chunk to its most compact representation.
+func (bv *adaptiveArray) Flush() error {
+	for _, ch := range bv.chunks {
+		ch.c = optimizeContainer(ch.c)
+		bv.resize(ch)
+	}
+	return nil
+}
+
+func (bv *adaptiveArray) Close() error {
+	bv.chunks = nil
+	bv.mem = 0
+	return bv.spill.close()
+}
+
+func (bv *adaptiveArray) Debug() string {
+	return debugImpl(bv)
+}
+
+func (bv *adaptiveArray) count() (uint64, error) {
+	var total uint64
+	for _, ch := range bv.chunks {
+		if ch.c != nil {
+			total += uint64(ch.c.card())
+		}
+	}
+	for ci := range bv.spill.index {
+		if _, found := bv.chunks[ci]; found {
+			continue
+		}
+		c, err := bv.loadSpilled(ci)
+		if err != nil {
+			return 0, err
+		}
+		if c != nil {
+			total += uint64(c.card())
+		}
+	}
+	return total, nil
+}
+
+// chunk returns the chunk with index ci, loading it from the spill file if
+// necessary.  If the chunk is empty, chunk returns nil unless create is true.
+func (bv *adaptiveArray) chunk(ci uint64, create bool) (*adaptiveChunk, error) {
+	bv.clock++
+	if ch, found := bv.chunks[ci]; found {
+		ch.stamp = bv.clock
+		return ch, nil
+	}
+
+	c, err := bv.loadSpilled(ci)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil && !create {
+		return nil, nil
+	}
+	if err := bv.evict(); err != nil {
+		return nil, err
+	}
+
+	ch := &adaptiveChunk{c: c, stamp: bv.clock}
+	bv.chunks[ci] = ch
+	bv.resize(ch)
+	return ch, nil
+}
+
+func (bv *adaptiveArray) loadSpilled(ci uint64) (container, error) {
+	data, found, err := bv.spill.load(ci, bv.buf)
+	bv.buf = data
+	if err != nil || !found {
+		return nil, err
+	}
+	return decodeContainer(data)
+}
+
+func (bv *adaptiveArray) update(ci uint64, ch *adaptiveChunk, x uint16, bit bool) {
+	switch {
+	case bit && ch.c == nil:
+		ch.c = arrayContainer{x}
+	case bit:
+		ch.c = ch.c.set(x)
+	case ch.c != nil:
+		ch.c = ch.c.clear(x)
+	default:
+		return
+	}
+	ch.dirty = true
+	bv.resize(ch)
+	if ch.c == nil && ch.pins == 0 {
+		bv.drop(ci, ch)
+	}
+}
+
+func (bv *adaptiveArray) resize(ch *adaptiveChunk) {
+	sz := uint64(chunkOverhead)
+	if ch.c != nil {
+		sz += uint64(ch.c.size())
+	}
+	bv.mem += sz - ch.sz
+	ch.sz = sz
+}
+
+func (bv *adaptiveArray) drop(ci uint64, ch *adaptiveChunk) {
+	delete(bv.chunks, ci)
+	bv.spill.remove(ci)
+	bv.mem -= ch.sz
+}
+
+func (bv *adaptiveArray) unpin(ci uint64, ch *adaptiveChunk) {
+	ch.pins--
+	if ch.c == nil && ch.pins == 0 && bv.chunks[ci] == ch {
+		bv.drop(ci, ch)
+	}
+}
+
+// evict spills the least recently used chunks to disk once resident chunks
+// use more than the configured limit.
+func (bv *adaptiveArray) evict() error {
+	if bv.mem <= bv.limit {
+		return nil
+	}
+
+	victims := make([]uint64, 0, len(bv.chunks))
+	for ci, ch := range bv.chunks {
+		if ch.pins == 0 {
+			victims = append(victims, ci)
+		}
+	}
+	sort.Slice(victims, func(i, j int) bool {
+		return bv.chunks[victims[i]].stamp < bv.chunks[victims[j]].stamp
+	})
+
+	target := bv.limit - bv.limit/4
+	for _, ci := range victims {
+		if bv.mem <= target {
+			break
+		}
+		ch := bv.chunks[ci]
+		if ch.dirty || !bv.spill.has(ci) {
+			ch.c = optimizeContainer(ch.c)
+			if ch.c == nil {
+				bv.drop(ci, ch)
+				continue
+			}
+			bv.buf = ch.c.encode(bv.buf[:0])
+			if err := bv.spill.store(ci, bv.buf); err != nil {
+				return err
+			}
+		}
+		delete(bv.chunks, ci)
+		bv.mem -= ch.sz
+	}
+	return nil
+}
+
+var _ BigBitVector = (*adaptiveArray)(nil)
+
+type adaptiveIterator struct {
+	bv     *adaptiveArray
+	ch     *adaptiveChunk
+	err    error
+	ci     uint64
+	base   uint64
+	pos    uint64
+	num    uint64
+	val    bool
+	primed bool
+	down   bool
+	loaded bool
+}
+
+func (iter *adaptiveIterator) Err() error { return iter.err }
+func (iter *adaptiveIterator) Next() bool { return iter.Skip(1) }
+
+func (iter *adaptiveIterator) Index() uint64 {
+	if !iter.primed {
+		panic("must call Next() before Index()")
+	}
+	if iter.pos >= iter.num {
+		panic("must not call Index() after Next() returns false")
+	}
+	if iter.down {
+		return iter.base + (iter.num - iter.pos - 1)
+	}
+	return iter.base + iter.pos
+}
+
+func (iter *adaptiveIterator) Bit() bool {
+	if !iter.primed {
+		panic("must call Next() before Bit()")
+	}
+	if iter.pos >= iter.num {
+		panic("must not call Bit() after Next() returns false")
+	}
+	return iter.val
+}
+
+func (iter *adaptiveIterator) SetBit(bit bool) {
+	if !iter.primed {
+		panic("must call Next() before SetBit()")
+	}
+	if iter.pos >= iter.num {
+		panic("must not call SetBit() after Next() returns false")
+	}
+	if iter.err != nil {
+		return
+	}
+	if iter.bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if iter.ch == nil {
+		if !bit {
+			return
+		}
+		ch, err := iter.bv.chunk(iter.ci, true)
+		if err != nil {
+			iter.err = err
+			return
+		}
+		ch.pins++
+		iter.ch = ch
+	}
+	iter.val = bit
+	iter.bv.update(iter.ci, iter.ch, uint16(iter.Index()%chunkBits), bit)
+}
+
+func (iter *adaptiveIterator) Skip(n uint64) bool {
+	if iter.pos > iter.num {
+		panic(fmt.Sprintf("iter.pos=%d iter.num=%d", iter.pos, iter.num))
+	}
+	if n == 0 && !iter.primed {
+		panic("must call Next() before Skip(0)")
+	}
+	if iter.err != nil {
+		return false
+	}
+	if !iter.primed {
+		n--
+		iter.primed = true
+	}
+	if n >= (iter.num - iter.pos) {
+		iter.pos = iter.num
+		iter.val = false
+		return false
+	}
+	iter.pos += n
+
+	index := iter.Index()
+	ci := index / chunkBits
+	if !iter.loaded || ci != iter.ci {
+		iter.release()
+		ch, err := iter.bv.chunk(ci, false)
+		if err != nil {
+			iter.err = err
+			iter.val = false
+			return false
+		}
+		if ch != nil {
+			ch.pins++
+		}
+		iter.ch = ch
+		iter.ci = ci
+		iter.loaded = true
+	}
+	iter.val = iter.ch != nil && iter.ch.c != nil && iter.ch.c.get(uint16(index%chunkBits))
+	return true
+}
+
+func (iter *adaptiveIterator) release() {
+	if iter.ch != nil {
+		iter.bv.unpin(iter.ci, iter.ch)
+		iter.ch = nil
+	}
+	iter.loaded = false
+}
+
+func (iter *adaptiveIterator) Flush() error {
+	return nil
+}
+
+func (iter *adaptiveIterator) Close() error {
+	err := iter.err
+	if err != ErrClosedIterator {
+		iter.release()
+		if err2 := iter.bv.evict(); err == nil {
+			err = err2
+		}
+	}
+	*iter = adaptiveIterator{bv: iter.bv, err: ErrClosedIterator}
+	return err
+}
+
+func (iter *adaptiveIterator) Reset(i, j uint64, reverse bool) error {
+	if i > j {
+		panic(fmt.Errorf("adaptiveIterator.Reset: i > j: i=%d j=%d", i, j))
+	}
+	iter.release()
+	err := iter.bv.evict()
+	*iter = adaptiveIterator{
+		bv:   iter.bv,
+		base: i,
+		num:  (j - i),
+		down: reverse,
+	}
+	return err
+}
+
+var _ Iterator = (*adaptiveIterator)(nil)
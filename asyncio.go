@@ -0,0 +1,333 @@
+package bigbitvector
+
+import (
+	"context"
+)
+
+// asyncState is the bookkeeping an onDiskArray keeps on behalf of iterators
+// that read ahead.  A page read in the background may be overtaken by a write
+// to the same page before the iterator gets to it; dirtied records the write
+// sequence number of each page written while any read-ahead is outstanding,
+// so that such reads can be recognized as stale and thrown away.
+type asyncState struct {
+	dirtied map[uint64]uint64
+	seq     uint64
+	reads   int
+}
+
+// noteWrite records that page off is about to be written.
+func (bv *onDiskArray) noteWrite(off uint64) {
+	bv.lock()
+	defer bv.unlock()
+	st := &bv.async
+	if st.reads == 0 {
+		return
+	}
+	if st.dirtied == nil {
+		st.dirtied = make(map[uint64]uint64)
+	}
+	st.seq++
+	st.dirtied[off] = st.seq
+}
+
+func (bv *onDiskArray) startRead() uint64 {
+	bv.lock()
+	defer bv.unlock()
+	bv.async.reads++
+	return bv.async.seq
+}
+
+// finishRead retires a read-ahead of page off which began at write sequence
+// number seq.  It returns true if the page has been written since.
+func (bv *onDiskArray) finishRead(off, seq uint64) bool {
+	bv.lock()
+	defer bv.unlock()
+	st := &bv.async
+	stale := st.dirtied[off] > seq
+	st.reads--
+	if st.reads == 0 {
+		st.dirtied = nil
+	}
+	return stale
+}
+
+// asyncOp is a single page read or write handed off to an I/O goroutine.
+type asyncOp struct {
+	ctx   context.Context
+	page  *cachePage
+	buf   []byte
+	data  []byte
+	off   uint64
+	seq   uint64
+	n     int
+	err   error
+	done  chan struct{}
+	zero  bool
+	write bool
+}
+
+// asyncIO runs an iterator's page reads and writes on a background goroutine.
+// Pages ahead of the iterator are read into private buffers and only enter
+// the cache once the iterator reaches them.  Pages behind the iterator are
+// copied and written back while the iterator moves on; each stays pinned in
+// the cache until its write completes, so nobody reads the old contents from
+// disk in the meantime.
+//
+// Only the goroutine running the iterator touches the bitvector's data
+// structures.  The I/O goroutine calls nothing but readPage and writePage.
+//
+type asyncIO struct {
+	bv     *onDiskArray
+	ops    chan *asyncOp
+	reads  []*asyncOp
+	writes []*asyncOp
+	err    error
+	next   uint64
+	last   uint64
+	depth  int
+	primed bool
+	more   bool
+	down   bool
+}
+
+func newAsyncIO(bv *onDiskArray, last uint64, down bool) *asyncIO {
+	a := &asyncIO{
+		bv:    bv,
+		ops:   make(chan *asyncOp, 2*bv.ra),
+		last:  last,
+		depth: int(bv.ra),
+		down:  down,
+	}
+	go a.run()
+	return a
+}
+
+func (a *asyncIO) run() {
+	for op := range a.ops {
+		switch {
+		case op.write:
+			op.err = a.bv.writePage(op.off, op.data, op.zero)
+		case op.ctx.Err() != nil:
+			// The iterator has given up; don't start reads it
+			// will only throw away.
+			op.err = op.ctx.Err()
+		default:
+			op.n, op.err = a.bv.readPage(op.off, op.data)
+		}
+		close(op.done)
+	}
+}
+
+// acquirePage acquires page off, using the contents read ahead if they are
+// available, and then starts reading the pages after it.
+func (a *asyncIO) acquirePage(ctx context.Context, off uint64) (*cachePage, error) {
+	bv := a.bv
+	a.reap(false)
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for len(a.reads) != 0 && a.before(a.reads[0].off, off) {
+		a.discard(a.popRead())
+	}
+
+	var page *cachePage
+	var err error
+	if len(a.reads) != 0 && a.reads[0].off == off {
+		page, err = a.install(ctx, a.popRead())
+	} else {
+		page, err = bv.acquirePageContext(ctx, off)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a.advance(off)
+	a.prefetch(ctx)
+	return page, nil
+}
+
+// before returns true if page x comes before page y in iteration order.
+func (a *asyncIO) before(x, y uint64) bool {
+	if a.down {
+		return x > y
+	}
+	return x < y
+}
+
+// advance moves the read-ahead window past page off.
+func (a *asyncIO) advance(off uint64) {
+	if a.primed && a.before(off, a.next) {
+		return
+	}
+	a.primed = true
+	psz := uint64(a.bv.psz)
+	if a.down {
+		a.more = off >= a.last+psz
+		a.next = off - psz
+	} else {
+		a.more = off+psz <= a.last
+		a.next = off + psz
+	}
+	if !a.more {
+		a.next = off
+	}
+}
+
+// prefetch starts reading pages ahead of the iterator, up to the configured
+// depth.  Pages that are already cached or known to be uniform are skipped.
+// The reads are bound to ctx, and those not yet started when it is done are
+// skipped.
+func (a *asyncIO) prefetch(ctx context.Context) {
+	bv := a.bv
+	psz := uint64(bv.psz)
+	for a.more && len(a.reads) < a.depth {
+		off := a.next
+		if off == a.last {
+			a.more = false
+		} else if a.down {
+			a.next -= psz
+		} else {
+			a.next += psz
+		}
+
+		if known, _ := bv.uni.get(off / psz); known || bv.isCached(off) {
+			continue
+		}
+		bb, b := bv.getBuffer()
+		op := &asyncOp{
+			ctx:  ctx,
+			buf:  bb,
+			data: b,
+			off:  off,
+			seq:  bv.startRead(),
+			done: make(chan struct{}),
+		}
+		a.reads = append(a.reads, op)
+		a.ops <- op
+	}
+}
+
+func (a *asyncIO) popRead() *asyncOp {
+	op := a.reads[0]
+	copy(a.reads, a.reads[1:])
+	a.reads[len(a.reads)-1] = nil
+	a.reads = a.reads[:len(a.reads)-1]
+	return op
+}
+
+// install moves a completed read-ahead into the cache.  If the read failed or
+// the page has changed since, the page is read again the usual way.
+func (a *asyncIO) install(ctx context.Context, op *asyncOp) (*cachePage, error) {
+	bv := a.bv
+	<-op.done
+	stale := bv.finishRead(op.off, op.seq)
+	if stale || op.err != nil || bv.isCached(op.off) {
+		bv.putBuffer(op.buf)
+		return bv.acquirePageContext(ctx, op.off)
+	}
+	if err := bv.reservePage(); err != nil {
+		bv.putBuffer(op.buf)
+		return nil, err
+	}
+	data := op.data[0:op.n]
+	bv.uni.classify(op.off/uint64(bv.psz), data)
+	return bv.insertPage(op.off, op.buf, data), nil
+}
+
+// discard throws away a read-ahead that the iterator skipped over.
+func (a *asyncIO) discard(op *asyncOp) {
+	<-op.done
+	a.bv.finishRead(op.off, op.seq)
+	a.bv.putBuffer(op.buf)
+}
+
+// writeBehind hands a dirty page off to be written in the background.  The
+// caller may dispose of its own reference to the page straight away.
+func (a *asyncIO) writeBehind(page *cachePage) error {
+	bv := a.bv
+	page.wait()
+	a.reap(false)
+	for len(a.writes) >= a.depth {
+		a.reap(true)
+	}
+
+	bb, b := bv.getBuffer()
+	b = b[0:copy(b, page.data)]
+	idx := page.off / uint64(bv.psz)
+	op := &asyncOp{
+		page:  page,
+		buf:   bb,
+		data:  b,
+		off:   page.off,
+		done:  make(chan struct{}),
+		zero:  bv.uni.classify(idx, b),
+		write: true,
+	}
+	bv.noteWrite(page.off)
+
+	bv.lock()
+	page.refcnt++
+	page.wb = op.done
+	bv.unlock()
+	page.dirty = false
+
+	a.writes = append(a.writes, op)
+	a.ops <- op
+	return a.err
+}
+
+// reap retires completed writes, recording the first error.  If wait is true,
+// it waits for at least one write to complete.
+func (a *asyncIO) reap(wait bool) {
+	bv := a.bv
+	for len(a.writes) != 0 {
+		op := a.writes[0]
+		if wait {
+			<-op.done
+			wait = false
+		} else {
+			select {
+			case <-op.done:
+			default:
+				return
+			}
+		}
+		a.writes[0] = nil
+		a.writes = a.writes[1:]
+
+		if op.err != nil {
+			bv.uni.forget(op.off / uint64(bv.psz))
+			if a.err == nil {
+				a.err = op.err
+			}
+		}
+		bv.lock()
+		if op.page.wb == op.done {
+			op.page.wb = nil
+		}
+		bv.unlock()
+		bv.putBuffer(op.buf)
+		bv.disposePage(op.page)
+	}
+}
+
+// drain waits for all pending writes to complete.
+func (a *asyncIO) drain() error {
+	for len(a.writes) != 0 {
+		a.reap(true)
+	}
+	return a.err
+}
+
+// close waits for all outstanding I/O and stops the I/O goroutine.
+func (a *asyncIO) close() {
+	a.drain()
+	for len(a.reads) != 0 {
+		a.discard(a.popRead())
+	}
+	close(a.ops)
+}
@@ -0,0 +1,413 @@
+package bigbitvector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync/atomic"
+)
+
+// AtomicBitVector is a BigBitVector whose bits may be read and written from
+// many goroutines at once without locking.  Every operation on a single bit
+// or word is atomic; operations spanning several words, such as CopyFrom or
+// an Iterator's scan, are not atomic as a whole.
+//
+// Truncate, Freeze, and Close must not race with other operations.
+//
+type AtomicBitVector interface {
+	BigBitVector
+
+	// TestAndSet sets the bit with the given index and returns its
+	// previous value.
+	TestAndSet(uint64) (bool, error)
+
+	// TestAndClear clears the bit with the given index and returns its
+	// previous value.
+	TestAndClear(uint64) (bool, error)
+
+	// LoadWord returns the 64-bit word with the given word index, which
+	// holds the bits with indices 64*w through 64*w+63.  Bit k of the word
+	// is the bit with index 64*w+k.
+	LoadWord(w uint64) (uint64, error)
+
+	// CompareAndSwapWord replaces the word with the given word index by
+	// new if it still equals old, and reports whether it did.  Bits past
+	// the end of the bitvector are ignored.
+	CompareAndSwapWord(w uint64, old, new uint64) (bool, error)
+}
+
+type atomicArray struct {
+	words []uint64
+	bits  uint64
+	ro    bool
+}
+
+func newAtomicArray(numValues uint64, ro bool) *atomicArray {
+	return &atomicArray{
+		words: make([]uint64, (numValues+63)/64),
+		bits:  numValues,
+		ro:    ro,
+	}
+}
+
+func wordAndMask(index uint64) (uint64, uint64) {
+	return index / 64, uint64(1) << (index % 64)
+}
+
+// tailMask returns the mask of the bits of word w which lie inside the
+// bitvector.
+func (bv *atomicArray) tailMask(w uint64) uint64 {
+	if end := bv.bits - w*64; end < 64 {
+		return uint64(1)<<end - 1
+	}
+	return ^uint64(0)
+}
+
+// update atomically replaces the bits of word w selected by mask with the
+// corresponding bits of val, and returns the previous word.
+func (bv *atomicArray) update(w uint64, mask, val uint64) uint64 {
+	p := &bv.words[w]
+	for {
+		old := atomic.LoadUint64(p)
+		new := (old & ^mask) | (val & mask)
+		if old == new || atomic.CompareAndSwapUint64(p, old, new) {
+			return old
+		}
+	}
+}
+
+func (bv *atomicArray) Frozen() bool {
+	return bv.ro
+}
+
+func (bv *atomicArray) Len() uint64 {
+	return bv.bits
+}
+
+func (bv *atomicArray) BitAt(index uint64) (bool, error) {
+	if index >= bv.Len() {
+		return false, io.EOF
+	}
+	w, m := wordAndMask(index)
+	return (atomic.LoadUint64(&bv.words[w]) & m) != 0, nil
+}
+
+func (bv *atomicArray) SetBitAt(index uint64, bit bool) error {
+	if bit {
+		_, err := bv.TestAndSet(index)
+		return err
+	}
+	_, err := bv.TestAndClear(index)
+	return err
+}
+
+func (bv *atomicArray) TestAndSet(index uint64) (bool, error) {
+	if bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if index >= bv.Len() {
+		return false, io.EOF
+	}
+	w, m := wordAndMask(index)
+	return (bv.update(w, m, m) & m) != 0, nil
+}
+
+func (bv *atomicArray) TestAndClear(index uint64) (bool, error) {
+	if bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if index >= bv.Len() {
+		return false, io.EOF
+	}
+	w, m := wordAndMask(index)
+	return (bv.update(w, m, 0) & m) != 0, nil
+}
+
+func (bv *atomicArray) LoadWord(w uint64) (uint64, error) {
+	if w >= uint64(len(bv.words)) {
+		return 0, io.EOF
+	}
+	return atomic.LoadUint64(&bv.words[w]) & bv.tailMask(w), nil
+}
+
+func (bv *atomicArray) CompareAndSwapWord(w uint64, old, new uint64) (bool, error) {
+	if bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if w >= uint64(len(bv.words)) {
+		return false, io.EOF
+	}
+	mask := bv.tailMask(w)
+	return atomic.CompareAndSwapUint64(&bv.words[w], old&mask, new&mask), nil
+}
+
+func (bv *atomicArray) Iterate(i, j uint64) Iterator {
+	if i > j {
+		panic(fmt.Errorf("atomicArray.Iterate: i > j: i=%d j=%d", i, j))
+	}
+	return &atomicIterator{
+		bv:   bv,
+		base: i,
+		num:  (j - i),
+	}
+}
+
+func (bv *atomicArray) ReverseIterate(i, j uint64) Iterator {
+	if i > j {
+		panic(fmt.Errorf("atomicArray.ReverseIterate: i > j: i=%d j=%d", i, j))
+	}
+	return &atomicIterator{
+		bv:   bv,
+		base: i,
+		num:  (j - i),
+		down: true,
+	}
+}
+
+func (bv *atomicArray) CopyFrom(src BigBitVector) error {
+	if bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if src.Len() != bv.Len() {
+		panic("bit arrays are not equal in size")
+	}
+	if x, ok := src.(*atomicArray); ok {
+		for w := range bv.words {
+			atomic.StoreUint64(&bv.words[w], atomic.LoadUint64(&x.words[w]))
+		}
+		return nil
+	}
+	return copyFromImpl(bv, src)
+}
+
+func (bv *atomicArray) Truncate(n uint64) error {
+	if bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if n > bv.Len() {
+		panic("cannot grow a bit array")
+	}
+	bv.words = bv.words[0 : (n+63)/64]
+	bv.bits = n
+	if n%64 != 0 {
+		// Clear the bits past the new end, so that they read as zero if
+		// they are ever exposed by a whole-word operation.
+		w := uint64(len(bv.words)) - 1
+		bv.update(w, ^bv.tailMask(w), 0)
+	}
+	return nil
+}
+
+func (bv *atomicArray) Freeze() error {
+	bv.ro = true
+	return nil
+}
+
+func (bv *atomicArray) Flush() error {
+	return nil
+}
+
+func (bv *atomicArray) Close() error {
+	return nil
+}
+
+func (bv *atomicArray) Debug() string {
+	return debugImpl(bv)
+}
+
+func (bv *atomicArray) count() (uint64, error) {
+	var total uint64
+	for w := range bv.words {
+		word := atomic.LoadUint64(&bv.words[w]) & bv.tailMask(uint64(w))
+		total += uint64(bits.OnesCount64(word))
+	}
+	return total, nil
+}
+
+var _ AtomicBitVector = (*atomicArray)(nil)
+
+type atomicIterator struct {
+	bv     *atomicArray
+	err    error
+	base   uint64
+	pos    uint64
+	num    uint64
+	val    bool
+	primed bool
+	down   bool
+}
+
+func (iter *atomicIterator) Err() error { return iter.err }
+func (iter *atomicIterator) Next() bool { return iter.Skip(1) }
+
+func (iter *atomicIterator) Index() uint64 {
+	if !iter.primed {
+		panic("must call Next() before Index()")
+	}
+	if iter.pos >= iter.num {
+		panic("must not call Index() after Next() returns false")
+	}
+	if iter.down {
+		return iter.base + (iter.num - iter.pos - 1)
+	}
+	return iter.base + iter.pos
+}
+
+func (iter *atomicIterator) Bit() bool {
+	if !iter.primed {
+		panic("must call Next() before Bit()")
+	}
+	if iter.pos >= iter.num {
+		panic("must not call Bit() after Next() returns false")
+	}
+	return iter.val
+}
+
+func (iter *atomicIterator) SetBit(bit bool) {
+	if !iter.primed {
+		panic("must call Next() before SetBit()")
+	}
+	if iter.pos >= iter.num {
+		panic("must not call SetBit() after Next() returns false")
+	}
+	if iter.err != nil {
+		return
+	}
+	if iter.bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	iter.val = bit
+	w, m := wordAndMask(iter.Index())
+	if bit {
+		iter.bv.update(w, m, m)
+	} else {
+		iter.bv.update(w, m, 0)
+	}
+}
+
+func (iter *atomicIterator) Skip(n uint64) bool {
+	if iter.pos > iter.num {
+		panic(fmt.Sprintf("iter.pos=%d iter.num=%d", iter.pos, iter.num))
+	}
+	if n == 0 && !iter.primed {
+		panic("must call Next() before Skip(0)")
+	}
+	if iter.err != nil {
+		return false
+	}
+	if !iter.primed {
+		n--
+		iter.primed = true
+	}
+	if n >= (iter.num - iter.pos) {
+		iter.pos = iter.num
+		iter.val = false
+		return false
+	}
+	iter.pos += n
+	w, m := wordAndMask(iter.Index())
+	iter.val = (atomic.LoadUint64(&iter.bv.words[w]) & m) != 0
+	return true
+}
+
+func (iter *atomicIterator) Flush() error {
+	return nil
+}
+
+func (iter *atomicIterator) Close() error {
+	err := iter.err
+	*iter = atomicIterator{bv: iter.bv, err: ErrClosedIterator}
+	return err
+}
+
+func (iter *atomicIterator) Reset(i, j uint64, reverse bool) error {
+	if i > j {
+		panic(fmt.Errorf("atomicIterator.Reset: i > j: i=%d j=%d", i, j))
+	}
+	*iter = atomicIterator{
+		bv:   iter.bv,
+		base: i,
+		num:  (j - i),
+		down: reverse,
+	}
+	return nil
+}
+
+var _ Iterator = (*atomicIterator)(nil)
+
+// atomicCursor presents an atomic bitvector as packed bytes, one emulated page
+// at a time.  Only the bits that changed are written back, each word with a
+// single atomic update, so concurrent writers to other bits are not lost.
+type atomicCursor struct {
+	bv    *atomicArray
+	buf   []byte
+	orig  []byte
+	base  uint64
+	valid bool
+	dirty bool
+}
+
+func (c *atomicCursor) load(off uint64) (uint64, []byte, error) {
+	base := off - off%genericPageSize
+	if c.valid && c.base == base {
+		return base, c.buf, nil
+	}
+	if err := c.flush(); err != nil {
+		return 0, nil, err
+	}
+	c.valid = false
+
+	numBytes := (c.bv.bits + 7) / 8
+	if base >= numBytes {
+		return 0, nil, io.EOF
+	}
+	n := numBytes - base
+	if n > genericPageSize {
+		n = genericPageSize
+	}
+	if c.buf == nil {
+		c.buf = make([]byte, genericPageSize+8)
+		c.orig = make([]byte, genericPageSize+8)
+	}
+	c.buf = c.buf[0:cap(c.buf)]
+	w0 := base / 8
+	for k := uint64(0); k*8 < n; k++ {
+		binary.LittleEndian.PutUint64(c.buf[k*8:], atomic.LoadUint64(&c.bv.words[w0+k]))
+	}
+	c.buf = c.buf[0:n]
+	c.orig = append(c.orig[:0], c.buf...)
+	c.base = base
+	c.valid = true
+	c.dirty = false
+	return base, c.buf, nil
+}
+
+func (c *atomicCursor) markDirty() {
+	c.dirty = true
+}
+
+func (c *atomicCursor) flush() error {
+	if !c.valid || !c.dirty {
+		return nil
+	}
+	w0 := c.base / 8
+	for k := 0; k < len(c.buf); k += 8 {
+		var cur, orig [8]byte
+		copy(cur[:], c.buf[k:])
+		copy(orig[:], c.orig[k:])
+		val := binary.LittleEndian.Uint64(cur[:])
+		if diff := val ^ binary.LittleEndian.Uint64(orig[:]); diff != 0 {
+			c.bv.update(w0+uint64(k/8), diff, val)
+		}
+	}
+	copy(c.orig, c.buf)
+	c.dirty = false
+	return nil
+}
+
+func (c *atomicCursor) close() error {
+	err := c.flush()
+	c.valid = false
+	return err
+}
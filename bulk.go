@@ -0,0 +1,239 @@
+package bigbitvector
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errWritePastEnd = errors.New("write past the end of the bitvector")
+
+// byteCursor provides random access to the packed bytes of a bitvector
+// through a pageCursor.
+type byteCursor struct {
+	pc   pageCursor
+	data []byte
+	base uint64
+}
+
+func newByteCursor(ba BigBitVector) *byteCursor {
+	return &byteCursor{pc: newPageCursor(ba)}
+}
+
+// at returns a pointer to the packed byte at offset off.
+func (c *byteCursor) at(off uint64) (*byte, error) {
+	if c.data == nil || off < c.base || off >= c.base+uint64(len(c.data)) {
+		base, data, err := c.pc.load(off)
+		if err != nil {
+			c.data = nil
+			return nil, err
+		}
+		c.base = base
+		c.data = data
+		if off-base >= uint64(len(data)) {
+			c.data = nil
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	return &c.data[off-c.base], nil
+}
+
+func (c *byteCursor) close(err error) error {
+	if err2 := c.pc.close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func checkBitRange(ba BigBitVector, op string, buf []byte, bitOff, nbits uint64) error {
+	if uint64(len(buf)) < (nbits+7)/8 {
+		panic(fmt.Errorf("%s: buffer too small: %d bytes for %d bits", op, len(buf), nbits))
+	}
+	if bitOff > ba.Len() || nbits > ba.Len()-bitOff {
+		return io.EOF
+	}
+	return nil
+}
+
+// ReadBits copies the nbits bits starting at index bitOff into dst, packed
+// the same way as the bitvector itself: bit i of the range lands in bit (i%8)
+// of dst[i/8].  Any remaining bits of the last byte written are cleared.
+//
+// ReadBits returns io.EOF, and reads nothing, if the range extends past the
+// end of the bitvector.
+//
+func ReadBits(ba BigBitVector, dst []byte, bitOff, nbits uint64) error {
+	if err := checkBitRange(ba, "ReadBits", dst, bitOff, nbits); err != nil {
+		return err
+	}
+	if nbits == 0 {
+		return nil
+	}
+
+	c := newByteCursor(ba)
+	s := uint(bitOff % 8)
+	first := bitOff / 8
+	last := (bitOff + nbits - 1) / 8
+	n := (nbits + 7) / 8
+	for k := uint64(0); k < n; k++ {
+		p, err := c.at(first + k)
+		if err != nil {
+			return c.close(err)
+		}
+		v := *p >> s
+		if s != 0 && first+k < last {
+			p, err = c.at(first + k + 1)
+			if err != nil {
+				return c.close(err)
+			}
+			v |= *p << (8 - s)
+		}
+		dst[k] = v
+	}
+	if r := nbits % 8; r != 0 {
+		dst[n-1] &= byte(1)<<r - 1
+	}
+	return c.close(nil)
+}
+
+// WriteBits replaces the nbits bits starting at index bitOff with the bits
+// packed in src, which uses the same layout as ReadBits.  On-disk bitvectors
+// write each page they touch back once.
+//
+// WriteBits returns io.EOF, and writes nothing, if the range extends past the
+// end of the bitvector.
+//
+func WriteBits(ba BigBitVector, src []byte, bitOff, nbits uint64) error {
+	if ba.Frozen() {
+		panic("BigBitVector is read-only")
+	}
+	if err := checkBitRange(ba, "WriteBits", src, bitOff, nbits); err != nil {
+		return err
+	}
+	if nbits == 0 {
+		return nil
+	}
+
+	c := newByteCursor(ba)
+	end := bitOff + nbits
+	for d := bitOff / 8; d <= (end-1)/8; d++ {
+		lo := d * 8
+		m := byte(0xff)
+		if lo < bitOff {
+			m <<= (bitOff - lo)
+		}
+		if lo+8 > end {
+			m &= byte(0xff) >> (lo + 8 - end)
+		}
+
+		var v byte
+		if lo < bitOff {
+			v = src[0] << (bitOff - lo)
+		} else {
+			pos := lo - bitOff
+			i, s := pos/8, uint(pos%8)
+			v = src[i] >> s
+			if s != 0 && i+1 < uint64(len(src)) {
+				v |= src[i+1] << (8 - s)
+			}
+		}
+
+		p, err := c.at(d)
+		if err != nil {
+			return c.close(err)
+		}
+		*p = (*p & ^m) | (v & m)
+		c.pc.markDirty()
+	}
+	return c.close(nil)
+}
+
+// AsFile presents the packed bytes of the bitvector as a File, so that it can
+// be handed to code which expects an io.ReaderAt or io.WriterAt.  Bit i of
+// the bitvector is bit (i%8) of byte (i/8).  The File cannot grow the
+// bitvector, and closing it only flushes the bitvector.
+func AsFile(ba BigBitVector) File {
+	return bitvectorFile{ba}
+}
+
+type bitvectorFile struct {
+	ba BigBitVector
+}
+
+// Size returns the number of packed bytes in the bitvector.
+func (f bitvectorFile) Size() uint64 {
+	return (f.ba.Len() + 7) / 8
+}
+
+// span clips the byte range [off, off+n) to the bitvector, returning the
+// number of bytes and bits it covers.
+func (f bitvectorFile) span(off int64, n int) (uint64, uint64, error) {
+	if off < 0 {
+		return 0, 0, errors.New("negative offset")
+	}
+	start := uint64(off)
+	size := f.Size()
+	if start >= size {
+		return 0, 0, nil
+	}
+	numBytes := uint64(n)
+	if numBytes > size-start {
+		numBytes = size - start
+	}
+	numBits := numBytes * 8
+	if start*8+numBits > f.ba.Len() {
+		numBits = f.ba.Len() - start*8
+	}
+	return numBytes, numBits, nil
+}
+
+func (f bitvectorFile) ReadAt(p []byte, off int64) (int, error) {
+	numBytes, numBits, err := f.span(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	if err := ReadBits(f.ba, p, uint64(off)*8, numBits); err != nil {
+		return 0, err
+	}
+	if numBytes < uint64(len(p)) {
+		return int(numBytes), io.EOF
+	}
+	return int(numBytes), nil
+}
+
+func (f bitvectorFile) WriteAt(p []byte, off int64) (int, error) {
+	numBytes, numBits, err := f.span(off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	if err := WriteBits(f.ba, p, uint64(off)*8, numBits); err != nil {
+		return 0, err
+	}
+	if numBytes < uint64(len(p)) {
+		return int(numBytes), errWritePastEnd
+	}
+	return int(numBytes), nil
+}
+
+func (f bitvectorFile) Truncate(size int64) error {
+	if size < 0 {
+		return errors.New("negative length")
+	}
+	if uint64(size) > f.Size() {
+		return errors.New("cannot grow a bit array")
+	}
+	if numBits := uint64(size) * 8; numBits < f.ba.Len() {
+		return f.ba.Truncate(numBits)
+	}
+	return nil
+}
+
+func (f bitvectorFile) Flush() error {
+	return f.ba.Flush()
+}
+
+func (f bitvectorFile) Close() error {
+	return f.ba.Flush()
+}
+
+var _ File = bitvectorFile{}
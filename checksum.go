@@ -0,0 +1,197 @@
+package bigbitvector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// checksumSize is the size of one entry in the checksum side table.  Each
+// entry holds the page's CRC32C followed by the CRC32C xor checksumMarker, so
+// that no recorded entry is all zeroes, not even one for a CRC32C of 0, and
+// an all-zero entry always means that none was recorded.
+//
+// A page without an entry is accepted only if it is all zeroes, as a page
+// which has never been flushed is.  Any other page must have been flushed, so
+// its missing entry is reported as corruption.
+const (
+	checksumSize   = 8
+	checksumMarker = 0x5a17c4e3
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptionError is returned when a page read from disk does not match its
+// recorded checksum.
+//
+// Missing is true if the page has no recorded checksum, even though it has
+// been written; Expected is then meaningless.
+type CorruptionError struct {
+	Offset   uint64
+	Expected uint32
+	Actual   uint32
+	Missing  bool
+}
+
+func (err *CorruptionError) Error() string {
+	if err.Missing {
+		return fmt.Sprintf(
+			"page at offset %d is corrupt: CRC32C %08x, but no checksum recorded",
+			err.Offset,
+			err.Actual)
+	}
+	return fmt.Sprintf(
+		"page at offset %d is corrupt: expected CRC32C %08x, got %08x",
+		err.Offset,
+		err.Expected,
+		err.Actual)
+}
+
+// Verify scrubs the whole bitvector, checking every page against its recorded
+// checksum.  It returns nil for bitvectors without checksums.
+func Verify(ba BigBitVector) error {
+	type verifier interface{ Verify() error }
+
+	if v, ok := ba.(verifier); ok {
+		return v.Verify()
+	}
+	return nil
+}
+
+// Verify flushes any pending writes, then reads back every page and checks
+// it against its recorded checksum.
+func (bv *onDiskArray) Verify() error {
+	if err := bv.Flush(); err != nil {
+		return err
+	}
+	if bv.ck == nil {
+		return nil
+	}
+
+	psz := uint64(bv.psz)
+	numBytes := (bv.num + 7) / 8
+	buf := make([]byte, psz)
+	for off := uint64(0); off < numBytes; off += psz {
+		n, err := bv.f.ReadAt(buf, int64(off))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err := bv.verifyPage(off, buf[0:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedChecksums records a checksum for every page which is not all zeroes,
+// trusting the file's current contents.  It fills in a fresh side table for
+// a file which already holds data.
+func (bv *onDiskArray) seedChecksums() error {
+	psz := uint64(bv.psz)
+	numBytes := (bv.num + 7) / 8
+	buf := make([]byte, psz)
+	for off := uint64(0); off < numBytes; off += psz {
+		n, err := bv.f.ReadAt(buf, int64(off))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if !isZero(buf[0:n]) {
+			if err := bv.storeChecksum(off, buf[0:n]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (bv *onDiskArray) checksumOffset(off uint64) int64 {
+	return int64((off / uint64(bv.psz)) * checksumSize)
+}
+
+// loadChecksum returns the recorded checksum of page off, and whether there
+// is one.
+func (bv *onDiskArray) loadChecksum(off uint64) (uint32, bool, error) {
+	var tmp [checksumSize]byte
+	n, err := bv.ck.ReadAt(tmp[:], bv.checksumOffset(off))
+	if err == io.EOF && n < checksumSize {
+		return 0, false, nil
+	}
+	if err != nil && err != io.EOF {
+		return 0, false, err
+	}
+	crc := binary.LittleEndian.Uint32(tmp[0:4])
+	check := binary.LittleEndian.Uint32(tmp[4:8])
+	return crc, crc != 0 || check != 0, nil
+}
+
+func (bv *onDiskArray) storeChecksum(off uint64, data []byte) error {
+	if bv.ck == nil {
+		return nil
+	}
+	var tmp [checksumSize]byte
+	crc := crc32.Checksum(data, crc32cTable)
+	binary.LittleEndian.PutUint32(tmp[0:4], crc)
+	binary.LittleEndian.PutUint32(tmp[4:8], crc^checksumMarker)
+	_, err := bv.ck.WriteAt(tmp[:], bv.checksumOffset(off))
+	return err
+}
+
+func (bv *onDiskArray) verifyPage(off uint64, data []byte) error {
+	if bv.ck == nil {
+		return nil
+	}
+	expected, found, err := bv.loadChecksum(off)
+	if err != nil {
+		return err
+	}
+	actual := crc32.Checksum(data, crc32cTable)
+	if !found {
+		if isZero(data) {
+			return nil
+		}
+		return &CorruptionError{
+			Offset:  off,
+			Actual:  actual,
+			Missing: true,
+		}
+	}
+	if actual != expected {
+		return &CorruptionError{
+			Offset:   off,
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
+	return nil
+}
+
+func (bv *onDiskArray) truncateWithChecksums(lengthBytes uint64) error {
+	psz := uint64(bv.psz)
+	lastOff := (lengthBytes / psz) * psz
+
+	var tail []byte
+	if lengthBytes > lastOff {
+		tail = make([]byte, psz)
+		n, err := bv.f.ReadAt(tail, int64(lastOff))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err := bv.verifyPage(lastOff, tail[0:n]); err != nil {
+			return err
+		}
+		tail = tail[0:(lengthBytes - lastOff)]
+	}
+
+	if err := bv.f.Truncate(int64(lengthBytes)); err != nil {
+		return err
+	}
+	numPages := (lengthBytes + psz - 1) / psz
+	if err := bv.ck.Truncate(int64(numPages * checksumSize)); err != nil {
+		return err
+	}
+	if tail != nil {
+		return bv.storeChecksum(lastOff, tail)
+	}
+	return nil
+}
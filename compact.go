@@ -0,0 +1,212 @@
+package bigbitvector
+
+import (
+	"io"
+	"math/bits"
+)
+
+// lowMask returns a word with the low k bits set.
+func lowMask(k uint) uint64 {
+	if k >= 64 {
+		return ^uint64(0)
+	}
+	return uint64(1)<<k - 1
+}
+
+// pext gathers the bits of x selected by m into the low bits of the result,
+// like the PEXT instruction, and returns how many there were.  It copies each
+// run of consecutive ones in m at once.
+func pext(x, m uint64) (uint64, uint) {
+	if m == ^uint64(0) {
+		return x, 64
+	}
+	var v uint64
+	var k uint
+	for m != 0 {
+		tz := uint(bits.TrailingZeros64(m))
+		run := uint(bits.TrailingZeros64(^(m >> tz)))
+		v |= ((x >> tz) & lowMask(run)) << k
+		k += run
+		m &= ^(lowMask(run) << tz)
+	}
+	return v, k
+}
+
+// pdep scatters the low bits of x to the positions selected by m, like the
+// PDEP instruction.
+func pdep(x, m uint64) uint64 {
+	if m == ^uint64(0) {
+		return x
+	}
+	var v uint64
+	for m != 0 {
+		tz := uint(bits.TrailingZeros64(m))
+		run := uint(bits.TrailingZeros64(^(m >> tz)))
+		v |= (x & lowMask(run)) << tz
+		x >>= run
+		m &= ^(lowMask(run) << tz)
+	}
+	return v
+}
+
+// wordWriter appends bits to a bitvector sequentially from index 0, a word at
+// a time.
+type wordWriter struct {
+	iter  WordIterator
+	limit uint64
+	count uint64
+	acc   uint64
+	n     uint
+}
+
+func newWordWriter(ba BigBitVector) *wordWriter {
+	return &wordWriter{iter: IterateWords(ba, 0, ba.Len()), limit: ba.Len()}
+}
+
+// write appends the low k bits of v, whose other bits must be clear.
+func (w *wordWriter) write(v uint64, k uint) error {
+	if k == 0 {
+		return nil
+	}
+	if w.count+uint64(k) > w.limit {
+		return io.EOF
+	}
+	w.count += uint64(k)
+	w.acc |= v << w.n
+	if w.n+k < 64 {
+		w.n += k
+		return nil
+	}
+	if !w.iter.Next() {
+		return w.iter.Err()
+	}
+	w.iter.SetWord(w.acc)
+	spill := w.n + k - 64
+	w.acc = 0
+	if spill != 0 {
+		w.acc = v >> (k - spill)
+	}
+	w.n = spill
+	return nil
+}
+
+// close writes out the final partial word, leaving the bits after it alone.
+func (w *wordWriter) close(err error) error {
+	if w.n != 0 && w.iter.Next() {
+		keep := ^lowMask(w.n)
+		w.iter.SetWord((w.iter.Word() & keep) | w.acc)
+	}
+	if err2 := w.iter.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// wordReader consumes the bits of a bitvector sequentially from index 0, a
+// word at a time.
+type wordReader struct {
+	iter  WordIterator
+	count uint64
+	acc   uint64
+	n     uint
+}
+
+func newWordReader(ba BigBitVector) *wordReader {
+	return &wordReader{iter: IterateWords(ba, 0, ba.Len())}
+}
+
+// read consumes the next k bits and returns them in the low bits of a word.
+func (r *wordReader) read(k uint) (uint64, error) {
+	if k == 0 {
+		return 0, nil
+	}
+	if r.n >= k {
+		v := r.acc & lowMask(k)
+		if k < 64 {
+			r.acc >>= k
+		} else {
+			r.acc = 0
+		}
+		r.n -= k
+		r.count += uint64(k)
+		return v, nil
+	}
+	if !r.iter.Next() {
+		if err := r.iter.Err(); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	word := r.iter.Word()
+	wn := uint(bits.OnesCount64(r.iter.Mask()))
+	need := k - r.n
+	if need > wn {
+		return 0, io.EOF
+	}
+	v := (r.acc | word<<r.n) & lowMask(k)
+	r.acc = 0
+	if need < 64 {
+		r.acc = word >> need
+	}
+	r.n = wn - need
+	r.count += uint64(k)
+	return v, nil
+}
+
+func (r *wordReader) close(err error) error {
+	if err2 := r.iter.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Compact copies the bits of src at the positions where mask is set, in
+// order, into the first bits of dst, like the PEXT instruction.  src and mask
+// must have the same length; dst may have any length, and only as many of its
+// bits as are written change.  It returns the number of bits written, or
+// io.EOF if they do not all fit in dst.
+//
+// src and mask are streamed together, a page at a time, and dst is written
+// sequentially, so they may use different backends: a huge on-disk mask can
+// select the few bits that fit in a small in-memory dst.  dst must not be
+// mask.
+//
+func Compact(dst, src, mask BigBitVector) (uint64, error) {
+	if dst.Frozen() {
+		panic("BigBitVector is read-only")
+	}
+	checkSameLen(src, mask)
+	w := newWordWriter(dst)
+	err := streamWords(nil, []BigBitVector{src, mask}, func(_, _ uint64, in []uint64) (uint64, error) {
+		if in[1] == 0 {
+			return 0, nil
+		}
+		v, k := pext(in[0], in[1])
+		return 0, w.write(v, k)
+	})
+	return w.count, w.close(err)
+}
+
+// Expand is the inverse of Compact, like the PDEP instruction: it copies the
+// first bits of src, in order, to the positions of dst where mask is set,
+// and clears the bits of dst where mask is clear.  dst and mask must have the
+// same length.  It returns the number of bits of src consumed, or io.EOF if
+// src has fewer bits than mask has set.  dst must not be src or mask.
+func Expand(dst, src, mask BigBitVector) (uint64, error) {
+	if dst.Frozen() {
+		panic("BigBitVector is read-only")
+	}
+	checkSameLen(dst, mask)
+	r := newWordReader(src)
+	err := streamWords(dst, []BigBitVector{mask}, func(_, _ uint64, in []uint64) (uint64, error) {
+		if in[0] == 0 {
+			return 0, nil
+		}
+		v, err := r.read(uint(bits.OnesCount64(in[0])))
+		if err != nil {
+			return 0, err
+		}
+		return pdep(v, in[0]), nil
+	})
+	return r.count, r.close(err)
+}
@@ -0,0 +1,84 @@
+package bigbitvector
+
+import (
+	"math/bits"
+)
+
+func minLen(a, b BigBitVector) uint64 {
+	if a.Len() < b.Len() {
+		return a.Len()
+	}
+	return b.Len()
+}
+
+// firstDifference returns the index of the first bit within the first num
+// bits at which a and b differ, and whether there is one.
+func firstDifference(a, b BigBitVector, num uint64) (uint64, bool, error) {
+	var index uint64
+	found := false
+	err := streamWordRange(nil, []BigBitVector{a, b}, num, func(i, _ uint64, in []uint64) (uint64, error) {
+		if diff := in[0] ^ in[1]; diff != 0 {
+			index = i + uint64(bits.TrailingZeros64(diff))
+			found = true
+			return 0, errStopStream
+		}
+		return 0, nil
+	})
+	return index, found, err
+}
+
+// FirstDifference returns the index of the first bit at which a and b differ,
+// or false if they are equal.  If one is a prefix of the other, they differ at
+// the index just past the end of the shorter one.  The scan stops at the
+// first difference.
+func FirstDifference(a, b BigBitVector) (uint64, bool, error) {
+	num := minLen(a, b)
+	index, found, err := firstDifference(a, b, num)
+	if err != nil || found {
+		return index, found, err
+	}
+	if a.Len() != b.Len() {
+		return num, true, nil
+	}
+	return 0, false, nil
+}
+
+// Equal returns true if a and b have the same length and the same bits.
+func Equal(a, b BigBitVector) (bool, error) {
+	if a.Len() != b.Len() {
+		return false, nil
+	}
+	_, found, err := firstDifference(a, b, a.Len())
+	return !found && err == nil, err
+}
+
+// Compare orders a and b lexicographically, starting from bit 0, with a clear
+// bit ordered before a set one.  A bitvector which is a prefix of another is
+// ordered before it.  The result is 0 if a == b, -1 if a < b, and +1 if
+// a > b.
+func Compare(a, b BigBitVector) (int, error) {
+	index, found, err := FirstDifference(a, b)
+	if err != nil || !found {
+		return 0, err
+	}
+	if index == minLen(a, b) {
+		if a.Len() < b.Len() {
+			return -1, nil
+		}
+		return +1, nil
+	}
+	bit, err := a.BitAt(index)
+	if err != nil {
+		return 0, err
+	}
+	if bit {
+		return +1, nil
+	}
+	return -1, nil
+}
+
+// HammingDistance returns the number of bits at which a and b differ.  The
+// bitvectors must have the same length.
+func HammingDistance(a, b BigBitVector) (uint64, error) {
+	return countWords(a, b, func(x, y uint64) uint64 { return x ^ y })
+}
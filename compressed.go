@@ -0,0 +1,543 @@
+package bigbitvector
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Codec selects the page compression scheme used by Compressed.
+type Codec uint8
+
+const (
+	// CodecFlate compresses each page with compress/flate.
+	CodecFlate Codec = iota + 1
+
+	// CodecRLE compresses each page with a simple byte-level run-length
+	// encoding.  It is much faster than CodecFlate and works well for
+	// vectors that are mostly long runs of 0s or 1s.
+	CodecRLE
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecFlate:
+		return "flate"
+	case CodecRLE:
+		return "rle"
+	default:
+		return fmt.Sprintf("Codec(%d)", uint8(c))
+	}
+}
+
+// The compressed file format consists of a fixed-size header followed by
+// extents holding compressed pages and the serialized page table.  The page
+// table maps page indices to extents; pages missing from the table are all
+// zeroes and take no space.
+//
+// Extents superseded by a rewrite are not reused until the next Flush has
+// persisted a page table that no longer refers to them.
+const (
+	zipMagic      = "BBVZIP01"
+	zipHeaderSize = 48 // magic, logical size, table offset, table length, page size, codec
+	zipEntrySize  = 20 // page index, extent offset, extent length
+	zipMaxPending = 1024
+	rleMinRun     = 4
+)
+
+var errCorruptPage = errors.New("compressed page is corrupt")
+
+type compressedFile struct {
+	f       File
+	codec   Codec
+	psz     uint64
+	ro      bool
+	mu      sync.Mutex
+	size    uint64
+	phys    uint64
+	table   map[uint64]extent
+	tab     extent
+	alloc   extentAllocator
+	pending []extent
+	dirty   bool
+	raw     []byte
+	zbuf    bytes.Buffer
+	zw      *flate.Writer
+	zr      io.ReadCloser
+}
+
+func newCompressedFile(f File, codec Codec, psz uint, ro bool) (*compressedFile, error) {
+	if codec != CodecFlate && codec != CodecRLE {
+		return nil, fmt.Errorf("unknown codec %v", codec)
+	}
+
+	cf := &compressedFile{
+		f:     f,
+		codec: codec,
+		psz:   uint64(psz),
+		ro:    ro,
+		table: make(map[uint64]extent),
+		alloc: newExtentAllocator(zipHeaderSize),
+	}
+
+	var hdr [zipHeaderSize]byte
+	n, err := f.ReadAt(hdr[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n == 0 {
+		cf.dirty = !ro
+		return cf, nil
+	}
+	if n < zipHeaderSize || string(hdr[0:8]) != zipMagic {
+		return nil, errors.New("file is not a compressed bitvector")
+	}
+	if x := binary.LittleEndian.Uint64(hdr[32:40]); x != cf.psz {
+		return nil, fmt.Errorf("compressed with page size %d, not %d", x, cf.psz)
+	}
+	cf.size = binary.LittleEndian.Uint64(hdr[8:16])
+	cf.tab.off = binary.LittleEndian.Uint64(hdr[16:24])
+	cf.tab.len = binary.LittleEndian.Uint64(hdr[24:32])
+	cf.codec = Codec(hdr[40])
+	if cf.codec != CodecFlate && cf.codec != CodecRLE {
+		return nil, fmt.Errorf("compressed with unknown codec %v", cf.codec)
+	}
+
+	buf := make([]byte, cf.tab.len)
+	if _, err := f.ReadAt(buf, int64(cf.tab.off)); err != nil {
+		return nil, err
+	}
+	used := make([]extent, 0, 1+len(buf)/zipEntrySize)
+	used = append(used, cf.tab)
+	for len(buf) >= zipEntrySize {
+		idx := binary.LittleEndian.Uint64(buf[0:8])
+		x := extent{
+			off: binary.LittleEndian.Uint64(buf[8:16]),
+			len: uint64(binary.LittleEndian.Uint32(buf[16:20])),
+		}
+		cf.table[idx] = x
+		used = append(used, x)
+		buf = buf[zipEntrySize:]
+	}
+	cf.alloc.rebuild(used)
+	cf.phys = ^uint64(0)
+	return cf, nil
+}
+
+func (cf *compressedFile) Wrapped() interface{} {
+	return cf.f
+}
+
+// Size returns the logical (uncompressed) size of the file.
+func (cf *compressedFile) Size() uint64 {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	return cf.size
+}
+
+func (cf *compressedFile) readPage(idx uint64, buf []byte) error {
+	x, found := cf.table[idx]
+	if !found {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return nil
+	}
+
+	if uint64(cap(cf.raw)) < x.len {
+		cf.raw = make([]byte, x.len)
+	}
+	raw := cf.raw[0:x.len]
+	if _, err := cf.f.ReadAt(raw, int64(x.off)); err != nil {
+		return err
+	}
+
+	var err error
+	switch cf.codec {
+	case CodecFlate:
+		err = cf.inflate(buf, raw)
+	case CodecRLE:
+		err = rleDecode(buf, raw)
+	default:
+		err = fmt.Errorf("unknown codec %v", cf.codec)
+	}
+	if err != nil {
+		return fmt.Errorf("page at offset %d: %v", idx*cf.psz, err)
+	}
+	return nil
+}
+
+func (cf *compressedFile) writePage(idx uint64, buf []byte) error {
+	old, found := cf.table[idx]
+	if isZero(buf) {
+		if found {
+			delete(cf.table, idx)
+			cf.pending = append(cf.pending, old)
+			cf.dirty = true
+		}
+		return nil
+	}
+
+	cf.zbuf.Reset()
+	switch cf.codec {
+	case CodecFlate:
+		if err := cf.deflate(buf); err != nil {
+			return err
+		}
+	case CodecRLE:
+		cf.raw = rleEncode(cf.raw[:0], buf)
+		cf.zbuf.Write(cf.raw)
+	default:
+		return fmt.Errorf("unknown codec %v", cf.codec)
+	}
+
+	x := cf.alloc.alloc(uint64(cf.zbuf.Len()))
+	if _, err := cf.f.WriteAt(cf.zbuf.Bytes(), int64(x.off)); err != nil {
+		cf.alloc.release(x)
+		return err
+	}
+	cf.grow(x)
+	cf.table[idx] = x
+	if found {
+		cf.pending = append(cf.pending, old)
+	}
+	cf.dirty = true
+
+	if len(cf.pending) >= zipMaxPending {
+		return cf.flushLocked()
+	}
+	return nil
+}
+
+func (cf *compressedFile) grow(x extent) {
+	if x.end() > cf.phys {
+		cf.phys = x.end()
+	}
+}
+
+func (cf *compressedFile) deflate(buf []byte) error {
+	if cf.zw == nil {
+		var err error
+		cf.zw, err = flate.NewWriter(&cf.zbuf, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+	} else {
+		cf.zw.Reset(&cf.zbuf)
+	}
+	if _, err := cf.zw.Write(buf); err != nil {
+		return err
+	}
+	return cf.zw.Close()
+}
+
+func (cf *compressedFile) inflate(buf, raw []byte) error {
+	r := bytes.NewReader(raw)
+	if cf.zr == nil {
+		cf.zr = flate.NewReader(r)
+	} else if err := cf.zr.(flate.Resetter).Reset(r, nil); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(cf.zr, buf); err != nil {
+		return errCorruptPage
+	}
+	return nil
+}
+
+func (cf *compressedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	start := uint64(off)
+	if start >= cf.size {
+		return 0, io.EOF
+	}
+	end := start + uint64(len(p))
+	var finalError error
+	if end > cf.size {
+		end = cf.size
+		finalError = io.EOF
+	}
+
+	buf := make([]byte, cf.psz)
+	n := 0
+	for pos := start; pos < end; {
+		idx := pos / cf.psz
+		if err := cf.readPage(idx, buf); err != nil {
+			return n, err
+		}
+		k := copy(p[n:n+int(end-pos)], buf[pos-idx*cf.psz:])
+		n += k
+		pos += uint64(k)
+	}
+	return n, finalError
+}
+
+func (cf *compressedFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	start := uint64(off)
+	end := start + uint64(len(p))
+
+	buf := make([]byte, cf.psz)
+	n := 0
+	for pos := start; pos < end; {
+		idx := pos / cf.psz
+		lo := pos - idx*cf.psz
+		k := cf.psz - lo
+		if k > end-pos {
+			k = end - pos
+		}
+		if k != cf.psz {
+			if err := cf.readPage(idx, buf); err != nil {
+				return n, err
+			}
+		}
+		copy(buf[lo:], p[n:n+int(k)])
+		if err := cf.writePage(idx, buf); err != nil {
+			return n, err
+		}
+		n += int(k)
+		pos += k
+	}
+
+	if end > cf.size {
+		cf.size = end
+		cf.dirty = true
+	}
+	return n, nil
+}
+
+func (cf *compressedFile) Truncate(length int64) error {
+	if length < 0 {
+		return errors.New("negative length")
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	size := uint64(length)
+	if size < cf.size {
+		numPages := (size + cf.psz - 1) / cf.psz
+		for idx, x := range cf.table {
+			if idx >= numPages {
+				delete(cf.table, idx)
+				cf.pending = append(cf.pending, x)
+			}
+		}
+
+		// Zero the tail of the new last page, so that growing the file
+		// again exposes zeroes just like a regular file would.
+		if lo := size % cf.psz; lo != 0 {
+			idx := size / cf.psz
+			buf := make([]byte, cf.psz)
+			if err := cf.readPage(idx, buf); err != nil {
+				return err
+			}
+			for i := lo; i < cf.psz; i++ {
+				buf[i] = 0
+			}
+			if err := cf.writePage(idx, buf); err != nil {
+				return err
+			}
+		}
+	}
+	cf.size = size
+	cf.dirty = true
+	return nil
+}
+
+// flushLocked persists the page table and header, then releases the extents
+// that the previous page table referred to.
+func (cf *compressedFile) flushLocked() error {
+	if !cf.dirty || cf.ro {
+		return nil
+	}
+
+	indices := make([]uint64, 0, len(cf.table))
+	for idx := range cf.table {
+		indices = append(indices, idx)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+
+	buf := make([]byte, len(indices)*zipEntrySize)
+	for i, idx := range indices {
+		x := cf.table[idx]
+		entry := buf[i*zipEntrySize : (i+1)*zipEntrySize]
+		binary.LittleEndian.PutUint64(entry[0:8], idx)
+		binary.LittleEndian.PutUint64(entry[8:16], x.off)
+		binary.LittleEndian.PutUint32(entry[16:20], uint32(x.len))
+	}
+	tab := cf.alloc.alloc(uint64(len(buf)))
+	if _, err := cf.f.WriteAt(buf, int64(tab.off)); err != nil {
+		cf.alloc.release(tab)
+		return err
+	}
+	cf.grow(tab)
+
+	var hdr [zipHeaderSize]byte
+	copy(hdr[0:8], zipMagic)
+	binary.LittleEndian.PutUint64(hdr[8:16], cf.size)
+	binary.LittleEndian.PutUint64(hdr[16:24], tab.off)
+	binary.LittleEndian.PutUint64(hdr[24:32], tab.len)
+	binary.LittleEndian.PutUint64(hdr[32:40], cf.psz)
+	hdr[40] = byte(cf.codec)
+	if _, err := cf.f.WriteAt(hdr[:], 0); err != nil {
+		cf.alloc.release(tab)
+		return err
+	}
+
+	cf.alloc.release(cf.tab)
+	for _, x := range cf.pending {
+		cf.alloc.release(x)
+	}
+	cf.tab = tab
+	cf.pending = cf.pending[:0]
+	cf.dirty = false
+
+	if cf.alloc.end < cf.phys {
+		if err := cf.f.Truncate(int64(cf.alloc.end)); err != nil {
+			return err
+		}
+		cf.phys = cf.alloc.end
+	}
+	return nil
+}
+
+func (cf *compressedFile) Flush() error {
+	type flusher interface{ Flush() error }
+
+	cf.mu.Lock()
+	err := cf.flushLocked()
+	cf.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if f, ok := cf.f.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (cf *compressedFile) Sync() error {
+	type syncer interface{ Sync() error }
+
+	if err := cf.Flush(); err != nil {
+		return err
+	}
+	if f, ok := cf.f.(syncer); ok {
+		return f.Sync()
+	}
+	return &NotImplementedError{Op: "Sync"}
+}
+
+func (cf *compressedFile) Name() string {
+	type namer interface{ Name() string }
+
+	return cf.f.(namer).Name()
+}
+
+func (cf *compressedFile) Close() error {
+	cf.mu.Lock()
+	err := cf.flushLocked()
+	cf.mu.Unlock()
+	if err2 := cf.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+var _ File = (*compressedFile)(nil)
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// rleEncode appends the run-length encoding of src to dst.  The encoding is a
+// sequence of tokens, each a uvarint (n<<1 | isRun) followed by either one
+// byte repeated n times or n literal bytes.
+func rleEncode(dst, src []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	literal := func(lit []byte) {
+		if len(lit) == 0 {
+			return
+		}
+		k := binary.PutUvarint(tmp[:], uint64(len(lit))<<1)
+		dst = append(dst, tmp[:k]...)
+		dst = append(dst, lit...)
+	}
+
+	lit := 0
+	i := 0
+	for i < len(src) {
+		j := i + 1
+		for j < len(src) && src[j] == src[i] {
+			j++
+		}
+		if j-i < rleMinRun {
+			i = j
+			continue
+		}
+		literal(src[lit:i])
+		k := binary.PutUvarint(tmp[:], uint64(j-i)<<1|1)
+		dst = append(dst, tmp[:k]...)
+		dst = append(dst, src[i])
+		i = j
+		lit = i
+	}
+	literal(src[lit:])
+	return dst
+}
+
+// rleDecode decodes src into dst, which must be exactly the decoded length.
+func rleDecode(dst, src []byte) error {
+	pos := 0
+	for len(src) > 0 {
+		v, k := binary.Uvarint(src)
+		if k <= 0 {
+			return errCorruptPage
+		}
+		src = src[k:]
+		n := int(v >> 1)
+		if n > len(dst)-pos {
+			return errCorruptPage
+		}
+		if v&1 != 0 {
+			if len(src) < 1 {
+				return errCorruptPage
+			}
+			b := src[0]
+			src = src[1:]
+			for i := pos; i < pos+n; i++ {
+				dst[i] = b
+			}
+		} else {
+			if len(src) < n {
+				return errCorruptPage
+			}
+			copy(dst[pos:pos+n], src[:n])
+			src = src[n:]
+		}
+		pos += n
+	}
+	if pos != len(dst) {
+		return errCorruptPage
+	}
+	return nil
+}
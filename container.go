@@ -0,0 +1,364 @@
+package bigbitvector
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+// A container holds the bits of one chunk of an adaptive bitvector.  The
+// mutating methods return the container that should replace the receiver,
+// which lets a container convert itself to a different representation once
+// its density changes.  A nil container is an empty chunk.
+type container interface {
+	get(x uint16) bool
+	set(x uint16) container
+	clear(x uint16) container
+	card() int
+	runs() int
+	size() int
+	toBitmap() *bitmapContainer
+	encode(dst []byte) []byte
+}
+
+const (
+	chunkBits    = 1 << 16
+	bitmapWords  = chunkBits / 64
+	bitmapSize   = chunkBits / 8
+	arrayMaxCard = bitmapSize / 2
+	runMaxRuns   = bitmapSize / 4
+	kindArray    = 1
+	kindBitmap   = 2
+	kindRun      = 3
+)
+
+var errCorruptChunk = errors.New("spilled chunk is corrupt")
+
+// optimizeContainer converts c to whichever representation is smallest.
+func optimizeContainer(c container) container {
+	if c == nil {
+		return nil
+	}
+	n := c.card()
+	if n == 0 {
+		return nil
+	}
+	arraySize := 2 * n
+	runSize := 4 * c.runs()
+	switch {
+	case n <= arrayMaxCard && arraySize <= runSize:
+		if _, ok := c.(arrayContainer); ok {
+			return c
+		}
+		return c.toBitmap().toArray()
+	case runSize < bitmapSize:
+		if _, ok := c.(runContainer); ok {
+			return c
+		}
+		return c.toBitmap().toRuns()
+	default:
+		return c.toBitmap()
+	}
+}
+
+func decodeContainer(data []byte) (container, error) {
+	if len(data) == 0 {
+		return nil, errCorruptChunk
+	}
+	kind, data := data[0], data[1:]
+	switch kind {
+	case kindArray:
+		if len(data)%2 != 0 {
+			return nil, errCorruptChunk
+		}
+		a := make(arrayContainer, len(data)/2)
+		for i := range a {
+			a[i] = binary.LittleEndian.Uint16(data[2*i:])
+		}
+		return a, nil
+	case kindBitmap:
+		if len(data) != bitmapSize {
+			return nil, errCorruptChunk
+		}
+		b := &bitmapContainer{}
+		for i := range b.w {
+			b.w[i] = binary.LittleEndian.Uint64(data[8*i:])
+			b.n += bits.OnesCount64(b.w[i])
+		}
+		return b, nil
+	case kindRun:
+		if len(data)%4 != 0 {
+			return nil, errCorruptChunk
+		}
+		r := make(runContainer, len(data)/4)
+		for i := range r {
+			r[i].start = binary.LittleEndian.Uint16(data[4*i:])
+			r[i].last = binary.LittleEndian.Uint16(data[4*i+2:])
+		}
+		return r, nil
+	default:
+		return nil, errCorruptChunk
+	}
+}
+
+// arrayContainer is a sorted list of the set positions.
+type arrayContainer []uint16
+
+func (a arrayContainer) search(x uint16) int {
+	return sort.Search(len(a), func(i int) bool { return a[i] >= x })
+}
+
+func (a arrayContainer) get(x uint16) bool {
+	i := a.search(x)
+	return i < len(a) && a[i] == x
+}
+
+func (a arrayContainer) set(x uint16) container {
+	i := a.search(x)
+	if i < len(a) && a[i] == x {
+		return a
+	}
+	a = append(a, 0)
+	copy(a[i+1:], a[i:])
+	a[i] = x
+	if len(a) > arrayMaxCard {
+		return optimizeContainer(a.toBitmap())
+	}
+	return a
+}
+
+func (a arrayContainer) clear(x uint16) container {
+	i := a.search(x)
+	if i >= len(a) || a[i] != x {
+		return a
+	}
+	a = append(a[:i], a[i+1:]...)
+	if len(a) == 0 {
+		return nil
+	}
+	return a
+}
+
+func (a arrayContainer) card() int { return len(a) }
+func (a arrayContainer) size() int { return 2 * len(a) }
+
+func (a arrayContainer) runs() int {
+	n := 0
+	for i, x := range a {
+		if i == 0 || a[i-1]+1 != x {
+			n++
+		}
+	}
+	return n
+}
+
+func (a arrayContainer) toBitmap() *bitmapContainer {
+	b := &bitmapContainer{n: len(a)}
+	for _, x := range a {
+		b.w[x/64] |= uint64(1) << (x % 64)
+	}
+	return b
+}
+
+func (a arrayContainer) encode(dst []byte) []byte {
+	dst = append(dst, kindArray)
+	for _, x := range a {
+		dst = append(dst, byte(x), byte(x>>8))
+	}
+	return dst
+}
+
+// bitmapContainer is a raw bitmap of the whole chunk.
+type bitmapContainer struct {
+	w [bitmapWords]uint64
+	n int
+}
+
+func (b *bitmapContainer) get(x uint16) bool {
+	return (b.w[x/64] & (uint64(1) << (x % 64))) != 0
+}
+
+func (b *bitmapContainer) set(x uint16) container {
+	m := uint64(1) << (x % 64)
+	if (b.w[x/64] & m) == 0 {
+		b.w[x/64] |= m
+		b.n++
+	}
+	return b
+}
+
+func (b *bitmapContainer) clear(x uint16) container {
+	m := uint64(1) << (x % 64)
+	if (b.w[x/64] & m) != 0 {
+		b.w[x/64] &= ^m
+		b.n--
+		if b.n <= arrayMaxCard {
+			return optimizeContainer(b)
+		}
+	}
+	return b
+}
+
+func (b *bitmapContainer) card() int { return b.n }
+func (b *bitmapContainer) size() int { return bitmapSize }
+
+func (b *bitmapContainer) runs() int {
+	n := 0
+	var carry uint64
+	for _, w := range b.w {
+		n += bits.OnesCount64(w &^ ((w << 1) | carry))
+		carry = w >> 63
+	}
+	return n
+}
+
+func (b *bitmapContainer) toBitmap() *bitmapContainer { return b }
+
+func (b *bitmapContainer) toArray() arrayContainer {
+	a := make(arrayContainer, 0, b.n)
+	for i, w := range b.w {
+		for w != 0 {
+			j := bits.TrailingZeros64(w)
+			a = append(a, uint16(i*64+j))
+			w &= w - 1
+		}
+	}
+	return a
+}
+
+func (b *bitmapContainer) toRuns() runContainer {
+	var r runContainer
+	inRun := false
+	for x := 0; x < chunkBits; x++ {
+		bit := b.get(uint16(x))
+		switch {
+		case bit && !inRun:
+			r = append(r, interval{start: uint16(x)})
+			inRun = true
+		case !bit && inRun:
+			r[len(r)-1].last = uint16(x - 1)
+			inRun = false
+		}
+	}
+	if inRun {
+		r[len(r)-1].last = chunkBits - 1
+	}
+	return r
+}
+
+func (b *bitmapContainer) encode(dst []byte) []byte {
+	dst = append(dst, kindBitmap)
+	var tmp [8]byte
+	for _, w := range b.w {
+		binary.LittleEndian.PutUint64(tmp[:], w)
+		dst = append(dst, tmp[:]...)
+	}
+	return dst
+}
+
+// interval is an inclusive range of set positions.
+type interval struct {
+	start uint16
+	last  uint16
+}
+
+// runContainer is a sorted list of disjoint, non-adjacent intervals.
+type runContainer []interval
+
+func (r runContainer) search(x uint16) int {
+	return sort.Search(len(r), func(i int) bool { return r[i].last >= x })
+}
+
+func (r runContainer) get(x uint16) bool {
+	i := r.search(x)
+	return i < len(r) && r[i].start <= x
+}
+
+func (r runContainer) set(x uint16) container {
+	i := r.search(x)
+	if i < len(r) && r[i].start <= x {
+		return r
+	}
+
+	joinPrev := i > 0 && int(r[i-1].last)+1 == int(x)
+	joinNext := i < len(r) && int(r[i].start) == int(x)+1
+	switch {
+	case joinPrev && joinNext:
+		r[i-1].last = r[i].last
+		r = append(r[:i], r[i+1:]...)
+	case joinPrev:
+		r[i-1].last = x
+	case joinNext:
+		r[i].start = x
+	default:
+		r = append(r, interval{})
+		copy(r[i+1:], r[i:])
+		r[i] = interval{start: x, last: x}
+		if len(r) > runMaxRuns {
+			return optimizeContainer(r)
+		}
+	}
+	return r
+}
+
+func (r runContainer) clear(x uint16) container {
+	i := r.search(x)
+	if i >= len(r) || r[i].start > x {
+		return r
+	}
+
+	iv := r[i]
+	switch {
+	case iv.start == iv.last:
+		r = append(r[:i], r[i+1:]...)
+		if len(r) == 0 {
+			return nil
+		}
+	case x == iv.start:
+		r[i].start++
+	case x == iv.last:
+		r[i].last--
+	default:
+		r = append(r, interval{})
+		copy(r[i+1:], r[i:])
+		r[i] = interval{start: iv.start, last: x - 1}
+		r[i+1] = interval{start: x + 1, last: iv.last}
+		if len(r) > runMaxRuns {
+			return optimizeContainer(r)
+		}
+	}
+	return r
+}
+
+func (r runContainer) card() int {
+	n := 0
+	for _, iv := range r {
+		n += int(iv.last) - int(iv.start) + 1
+	}
+	return n
+}
+
+func (r runContainer) runs() int { return len(r) }
+func (r runContainer) size() int { return 4 * len(r) }
+
+func (r runContainer) toBitmap() *bitmapContainer {
+	b := &bitmapContainer{}
+	for _, iv := range r {
+		for x := int(iv.start); x <= int(iv.last); x++ {
+			b.w[x/64] |= uint64(1) << uint(x%64)
+		}
+		b.n += int(iv.last) - int(iv.start) + 1
+	}
+	return b
+}
+
+func (r runContainer) encode(dst []byte) []byte {
+	dst = append(dst, kindRun)
+	for _, iv := range r {
+		dst = append(dst,
+			byte(iv.start), byte(iv.start>>8),
+			byte(iv.last), byte(iv.last>>8))
+	}
+	return dst
+}
@@ -0,0 +1,100 @@
+package bigbitvector
+
+import (
+	"context"
+)
+
+// contextBinder is implemented by iterators which can check a context
+// themselves, between page loads.
+type contextBinder interface {
+	bindContext(context.Context)
+}
+
+// BindContext returns an Iterator which behaves like iter until the context is
+// done.  After that, Next and Skip return false and Err returns the context's
+// error.  On-disk iterators, including those inside Hybrid iterators, also
+// stop before starting to read another page, and skip any read-ahead not yet
+// under way; reads already in progress run to completion.
+//
+// The returned Iterator takes ownership of iter; close the returned Iterator
+// instead of iter.
+func BindContext(ctx context.Context, iter Iterator) Iterator {
+	if b, ok := iter.(contextBinder); ok {
+		b.bindContext(ctx)
+	}
+	return &contextIterator{Iterator: iter, ctx: ctx, done: ctx.Done()}
+}
+
+type contextIterator struct {
+	Iterator
+	ctx  context.Context
+	done <-chan struct{}
+	err  error
+}
+
+func (iter *contextIterator) check() bool {
+	if iter.err != nil {
+		return false
+	}
+	select {
+	case <-iter.done:
+		iter.err = iter.ctx.Err()
+		return false
+	default:
+		return true
+	}
+}
+
+func (iter *contextIterator) Next() bool {
+	return iter.check() && iter.Iterator.Next()
+}
+
+func (iter *contextIterator) Skip(n uint64) bool {
+	return iter.check() && iter.Iterator.Skip(n)
+}
+
+func (iter *contextIterator) Err() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	return iter.Iterator.Err()
+}
+
+func (iter *contextIterator) Reset(i, j uint64, reverse bool) error {
+	iter.err = nil
+	return iter.Iterator.Reset(i, j, reverse)
+}
+
+func (iter *contextIterator) Close() error {
+	err := iter.Iterator.Close()
+	if iter.err != nil && err != ErrClosedIterator {
+		err = iter.err
+	}
+	iter.err = nil
+	return err
+}
+
+var _ Iterator = (*contextIterator)(nil)
+
+// ForEachContext is like ForEach, but stops early with the context's error
+// once the context is done.
+func ForEachContext(ctx context.Context, ba BigBitVector, fn func(uint64, bool) error) error {
+	return forEachIter(BindContext(ctx, ba.Iterate(0, ba.Len())), fn)
+}
+
+// ReverseForEachContext is like ReverseForEach, but stops early with the
+// context's error once the context is done.
+func ReverseForEachContext(ctx context.Context, ba BigBitVector, fn func(uint64, bool) error) error {
+	return forEachIter(BindContext(ctx, ba.ReverseIterate(0, ba.Len())), fn)
+}
+
+func forEachIter(iter Iterator, fn func(uint64, bool) error) error {
+	for iter.Next() {
+		err := fn(iter.Index(), iter.Bit())
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
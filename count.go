@@ -0,0 +1,77 @@
+package bigbitvector
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Count returns the number of set bits in the bitvector.
+func Count(ba BigBitVector) (uint64, error) {
+	type counter interface{ count() (uint64, error) }
+
+	if c, ok := ba.(counter); ok {
+		return c.count()
+	}
+
+	var total uint64
+	err := ForEach(ba, func(_ uint64, bit bool) error {
+		if bit {
+			total++
+		}
+		return nil
+	})
+	return total, err
+}
+
+func (bv *inMemoryArray) count() (uint64, error) {
+	return popcountBytes(bv.data, bv.bits), nil
+}
+
+func (bv *onDiskArray) count() (uint64, error) {
+	psz := uint64(bv.psz)
+	numBytes := (bv.num + 7) / 8
+
+	var total uint64
+	for off := uint64(0); off < numBytes; off += psz {
+		numBits := bv.num - off*8
+		if numBits > psz*8 {
+			numBits = psz * 8
+		}
+
+		if known, ones := bv.uni.get(off / psz); known {
+			if ones {
+				total += numBits
+			}
+			continue
+		}
+
+		page, err := bv.acquirePage(off)
+		if err != nil {
+			return 0, err
+		}
+		total += popcountBytes(page.data, numBits)
+		bv.disposePage(page)
+	}
+	return total, nil
+}
+
+// popcountBytes counts the set bits among the first numBits bits of data.
+func popcountBytes(data []byte, numBits uint64) uint64 {
+	var total uint64
+	full := numBits / 8
+	if full >= uint64(len(data)) {
+		full = uint64(len(data))
+	} else if r := numBits % 8; r != 0 {
+		total += uint64(bits.OnesCount8(data[full] & (byte(1)<<r - 1)))
+	}
+
+	data = data[0:full]
+	for len(data) >= 8 {
+		total += uint64(bits.OnesCount64(binary.LittleEndian.Uint64(data)))
+		data = data[8:]
+	}
+	for _, b := range data {
+		total += uint64(bits.OnesCount8(b))
+	}
+	return total
+}
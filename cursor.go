@@ -0,0 +1,157 @@
+package bigbitvector
+
+import (
+	"fmt"
+)
+
+// Cursor provides random access to a BigBitVector which is cheap for short
+// moves in either direction.  The page holding the cursor's position stays
+// loaded until the cursor leaves it, so a Cursor must be closed before the
+// bitvector is truncated or closed.
+//
+// A new Cursor has no position.  The first call to Next moves it to the first
+// bit, and the first call to Prev moves it to the last.  Moves that would
+// leave the bitvector return false and leave the cursor where it was.
+//
+// The basic usage pattern for a sliding window is:
+//
+//   lead, trail := NewCursor(vec), NewCursor(vec)
+//   for lead.Next() {
+//     ... // add lead.Bit()
+//     if lead.Index() >= width {
+//       trail.Next()
+//       ... // remove trail.Bit()
+//     }
+//   }
+//
+type Cursor struct {
+	bc    *byteCursor
+	err   error
+	num   uint64
+	pos   uint64
+	val   bool
+	valid bool
+	ro    bool
+}
+
+// NewCursor returns a Cursor over the bitvector.
+func NewCursor(ba BigBitVector) *Cursor {
+	return &Cursor{
+		bc:  newByteCursor(ba),
+		num: ba.Len(),
+		ro:  ba.Frozen(),
+	}
+}
+
+// Err returns the error which caused a move to fail, if any.
+func (c *Cursor) Err() error { return c.err }
+
+// Seek moves the cursor to the given index.  It returns false if the index is
+// out of range or an error occurred.
+func (c *Cursor) Seek(index uint64) bool {
+	if c.err != nil || index >= c.num {
+		return false
+	}
+	return c.move(index)
+}
+
+// Next moves the cursor forward by one bit.
+func (c *Cursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
+	if !c.valid {
+		return c.num != 0 && c.move(0)
+	}
+	if c.pos+1 >= c.num {
+		return false
+	}
+	return c.move(c.pos + 1)
+}
+
+// Prev moves the cursor backward by one bit.
+func (c *Cursor) Prev() bool {
+	if c.err != nil {
+		return false
+	}
+	if !c.valid {
+		return c.num != 0 && c.move(c.num-1)
+	}
+	if c.pos == 0 {
+		return false
+	}
+	return c.move(c.pos - 1)
+}
+
+func (c *Cursor) move(index uint64) bool {
+	b, m := byteAndMask(index)
+	p, err := c.bc.at(b)
+	if err != nil {
+		c.err = err
+		return false
+	}
+	c.pos = index
+	c.val = (*p & m) != 0
+	c.valid = true
+	return true
+}
+
+func (c *Cursor) check(method string) {
+	if !c.valid {
+		panic(fmt.Sprintf("must position the Cursor before %s()", method))
+	}
+}
+
+// Index returns the index of the bit under the cursor.
+func (c *Cursor) Index() uint64 {
+	c.check("Index")
+	return c.pos
+}
+
+// Bit returns the bit under the cursor.
+func (c *Cursor) Bit() bool {
+	c.check("Bit")
+	return c.val
+}
+
+// SetBit replaces the bit under the cursor.
+func (c *Cursor) SetBit(bit bool) {
+	c.check("SetBit")
+	if c.err != nil {
+		return
+	}
+	if c.ro {
+		panic("BigBitVector is read-only")
+	}
+	b, m := byteAndMask(c.pos)
+	p, err := c.bc.at(b)
+	if err != nil {
+		c.err = err
+		return
+	}
+	if bit {
+		*p |= m
+	} else {
+		*p &= ^m
+	}
+	c.bc.pc.markDirty()
+	c.val = bit
+}
+
+// Flush ensures that all pending writes have reached the OS.
+func (c *Cursor) Flush() error {
+	if c.bc == nil {
+		return nil
+	}
+	return c.bc.pc.flush()
+}
+
+// Close flushes any writes and releases the cursor's page.
+func (c *Cursor) Close() error {
+	if c.bc == nil {
+		return ErrClosedIterator
+	}
+	err := c.bc.close(c.err)
+	*c = Cursor{err: ErrClosedIterator}
+	return err
+}
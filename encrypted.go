@@ -0,0 +1,372 @@
+package bigbitvector
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+)
+
+// The encrypted file format consists of a fixed-size header followed by one
+// slot per page.  Each slot holds a 4-byte generation counter followed by the
+// AES-GCM sealed page.  A slot with generation 0 (or a slot past the physical
+// end of the file) has never been written and reads as zeroes.
+//
+// The nonce for a page is its index followed by its generation, so each write
+// to a page bumps the generation to avoid nonce reuse.  Truncate discards the
+// generations of the slots it drops, so it first raises a generation floor,
+// kept in the header, above all of them; later writes to any page start above
+// the floor.  The random salt in the header makes the effective key unique to
+// each file.
+const (
+	encMagic      = "BBVENC01"
+	encHeaderSize = 36 // magic, logical size, salt, generation floor
+	encGenSize    = 4
+	encNonceSize  = 12
+)
+
+// DecryptionError is returned when an encrypted page fails authentication.
+type DecryptionError struct {
+	Offset uint64
+}
+
+func (err *DecryptionError) Error() string {
+	return fmt.Sprintf("page at offset %d failed authentication", err.Offset)
+}
+
+type encryptedFile struct {
+	f     File
+	aead  cipher.AEAD
+	psz   uint64
+	ssz   uint64
+	rw    sync.RWMutex
+	mu    sync.Mutex
+	size  uint64
+	floor uint32
+}
+
+func newEncryptedFile(f File, key []byte, psz uint) (*encryptedFile, error) {
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+
+	var hdr [encHeaderSize]byte
+	n, err := f.ReadAt(hdr[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	ef := &encryptedFile{f: f, psz: uint64(psz)}
+	switch {
+	case n == 0:
+		copy(hdr[0:8], encMagic)
+		if _, err := rand.Read(hdr[16:32]); err != nil {
+			return nil, err
+		}
+		if _, err := f.WriteAt(hdr[:], 0); err != nil {
+			return nil, err
+		}
+	case n < encHeaderSize || string(hdr[0:8]) != encMagic:
+		return nil, errors.New("file is not an encrypted bitvector")
+	default:
+		ef.size = binary.LittleEndian.Uint64(hdr[8:16])
+		ef.floor = binary.LittleEndian.Uint32(hdr[32:36])
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("bigbitvector page key"))
+	mac.Write(hdr[16:32])
+	block, err := aes.NewCipher(mac.Sum(nil)[0:len(key)])
+	if err != nil {
+		return nil, err
+	}
+	ef.aead, err = cipher.NewGCMWithNonceSize(block, encNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	ef.ssz = encGenSize + ef.psz + uint64(ef.aead.Overhead())
+	return ef, nil
+}
+
+func (ef *encryptedFile) Wrapped() interface{} {
+	return ef.f
+}
+
+// Size returns the logical (plaintext) size of the file.
+func (ef *encryptedFile) Size() uint64 {
+	ef.mu.Lock()
+	defer ef.mu.Unlock()
+	return ef.size
+}
+
+func (ef *encryptedFile) setSize(size uint64) error {
+	ef.mu.Lock()
+	defer ef.mu.Unlock()
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], size)
+	if _, err := ef.f.WriteAt(tmp[:], 8); err != nil {
+		return err
+	}
+	ef.size = size
+	return nil
+}
+
+// raiseFloor raises the generation floor to gen, if it is lower.
+func (ef *encryptedFile) raiseFloor(gen uint32) error {
+	ef.mu.Lock()
+	defer ef.mu.Unlock()
+	if gen <= ef.floor {
+		return nil
+	}
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], gen)
+	if _, err := ef.f.WriteAt(tmp[:], 32); err != nil {
+		return err
+	}
+	ef.floor = gen
+	return nil
+}
+
+func (ef *encryptedFile) slotOffset(idx uint64) int64 {
+	return int64(encHeaderSize + idx*ef.ssz)
+}
+
+func (ef *encryptedFile) nonce(idx uint64, gen uint32) []byte {
+	var nonce [encNonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[0:8], idx)
+	binary.LittleEndian.PutUint32(nonce[8:12], gen)
+	return nonce[:]
+}
+
+func (ef *encryptedFile) readGen(idx uint64) (uint32, error) {
+	var tmp [encGenSize]byte
+	n, err := ef.f.ReadAt(tmp[:], ef.slotOffset(idx))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if n < encGenSize {
+		return 0, nil
+	}
+	return binary.LittleEndian.Uint32(tmp[:]), nil
+}
+
+// readPage decrypts page idx into buf, which must be psz bytes long.  slot is
+// scratch space of ssz bytes.  It returns the page's current generation.
+func (ef *encryptedFile) readPage(idx uint64, buf, slot []byte) (uint32, error) {
+	n, err := ef.f.ReadAt(slot, ef.slotOffset(idx))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	var gen uint32
+	if n >= encGenSize {
+		gen = binary.LittleEndian.Uint32(slot[0:encGenSize])
+	}
+	if gen == 0 {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return 0, nil
+	}
+	if uint64(n) < ef.ssz {
+		return 0, &DecryptionError{Offset: idx * ef.psz}
+	}
+
+	_, err = ef.aead.Open(buf[:0], ef.nonce(idx, gen), slot[encGenSize:], nil)
+	if err != nil {
+		return 0, &DecryptionError{Offset: idx * ef.psz}
+	}
+	return gen, nil
+}
+
+func (ef *encryptedFile) writePage(idx uint64, gen uint32, buf, slot []byte) error {
+	ef.mu.Lock()
+	if gen < ef.floor {
+		gen = ef.floor
+	}
+	ef.mu.Unlock()
+	if gen == math.MaxUint32 {
+		return fmt.Errorf("page at offset %d: generation counter exhausted", idx*ef.psz)
+	}
+	gen++
+	binary.LittleEndian.PutUint32(slot[0:encGenSize], gen)
+	ef.aead.Seal(slot[encGenSize:encGenSize], ef.nonce(idx, gen), buf, nil)
+	_, err := ef.f.WriteAt(slot, ef.slotOffset(idx))
+	return err
+}
+
+func (ef *encryptedFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	ef.rw.RLock()
+	defer ef.rw.RUnlock()
+	size := ef.Size()
+	start := uint64(off)
+	if start >= size {
+		return 0, io.EOF
+	}
+	end := start + uint64(len(p))
+	var finalError error
+	if end > size {
+		end = size
+		finalError = io.EOF
+	}
+
+	buf := make([]byte, ef.psz)
+	slot := make([]byte, ef.ssz)
+	n := 0
+	for pos := start; pos < end; {
+		idx := pos / ef.psz
+		if _, err := ef.readPage(idx, buf, slot); err != nil {
+			return n, err
+		}
+		k := copy(p[n:n+int(end-pos)], buf[pos-idx*ef.psz:])
+		n += k
+		pos += uint64(k)
+	}
+	return n, finalError
+}
+
+// WriteAt holds rw exclusively from reading each page's generation until the
+// page is sealed and written back, so that concurrent writers to the same
+// page can't both seal under the next generation's nonce.
+func (ef *encryptedFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	ef.rw.Lock()
+	defer ef.rw.Unlock()
+	start := uint64(off)
+	end := start + uint64(len(p))
+
+	buf := make([]byte, ef.psz)
+	slot := make([]byte, ef.ssz)
+	n := 0
+	for pos := start; pos < end; {
+		idx := pos / ef.psz
+		lo := pos - idx*ef.psz
+		k := ef.psz - lo
+		if k > end-pos {
+			k = end - pos
+		}
+
+		var gen uint32
+		var err error
+		if k == ef.psz {
+			gen, err = ef.readGen(idx)
+		} else {
+			gen, err = ef.readPage(idx, buf, slot)
+		}
+		if err != nil {
+			return n, err
+		}
+		copy(buf[lo:], p[n:n+int(k)])
+		if err := ef.writePage(idx, gen, buf, slot); err != nil {
+			return n, err
+		}
+		n += int(k)
+		pos += k
+	}
+
+	if end > ef.Size() {
+		if err := ef.setSize(end); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (ef *encryptedFile) Truncate(length int64) error {
+	if length < 0 {
+		return errors.New("negative length")
+	}
+	ef.rw.Lock()
+	defer ef.rw.Unlock()
+	size := uint64(length)
+	old := ef.Size()
+	if size >= old {
+		return ef.setSize(size)
+	}
+
+	// Zero the tail of the new last page, so that growing the file again
+	// exposes zeroes just like a regular file would.
+	if lo := size % ef.psz; lo != 0 {
+		idx := size / ef.psz
+		buf := make([]byte, ef.psz)
+		slot := make([]byte, ef.ssz)
+		gen, err := ef.readPage(idx, buf, slot)
+		if err != nil {
+			return err
+		}
+		for i := lo; i < ef.psz; i++ {
+			buf[i] = 0
+		}
+		if err := ef.writePage(idx, gen, buf, slot); err != nil {
+			return err
+		}
+	}
+
+	// Raise the floor above the generations of every slot about to be
+	// dropped, including any written past the logical size, before they
+	// are lost.
+	numPages := (size + ef.psz - 1) / ef.psz
+	var top uint32
+	for idx := numPages; ; idx++ {
+		var tmp [encGenSize]byte
+		n, err := ef.f.ReadAt(tmp[:], ef.slotOffset(idx))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n < encGenSize {
+			break
+		}
+		if gen := binary.LittleEndian.Uint32(tmp[:]); gen > top {
+			top = gen
+		}
+	}
+	if err := ef.raiseFloor(top); err != nil {
+		return err
+	}
+	if err := ef.f.Truncate(ef.slotOffset(numPages)); err != nil {
+		return err
+	}
+	return ef.setSize(size)
+}
+
+func (ef *encryptedFile) Flush() error {
+	type flusher interface{ Flush() error }
+
+	if f, ok := ef.f.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (ef *encryptedFile) Sync() error {
+	type syncer interface{ Sync() error }
+
+	if f, ok := ef.f.(syncer); ok {
+		return f.Sync()
+	}
+	return &NotImplementedError{Op: "Sync"}
+}
+
+func (ef *encryptedFile) Name() string {
+	type namer interface{ Name() string }
+
+	return ef.f.(namer).Name()
+}
+
+func (ef *encryptedFile) Close() error {
+	return ef.f.Close()
+}
+
+var _ File = (*encryptedFile)(nil)
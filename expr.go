@@ -0,0 +1,217 @@
+package bigbitvector
+
+import (
+	"math/bits"
+)
+
+// Expr is a boolean expression over bitvectors of equal length, such as
+//
+//   Or(And(Leaf(a), Leaf(b)), And(Leaf(c), Not(Leaf(d))))
+//
+// Expressions are evaluated lazily, by Materialize, CountExpr, or ForEachExpr,
+// in a single pass which streams every distinct leaf page by page and reads
+// each page once, without any intermediate bitvectors.
+//
+type Expr interface {
+	// Len returns the number of bits in the value of the expression.
+	Len() uint64
+
+	compile(c *exprCompiler)
+}
+
+type exprOp uint8
+
+const (
+	opLeaf exprOp = iota
+	opNot
+	opAnd
+	opOr
+	opXor
+)
+
+type leafExpr struct {
+	ba BigBitVector
+}
+
+type notExpr struct {
+	x Expr
+}
+
+type listExpr struct {
+	op exprOp
+	xs []Expr
+}
+
+// Leaf returns an expression whose value is the bitvector itself.
+func Leaf(ba BigBitVector) Expr {
+	return leafExpr{ba}
+}
+
+// Not returns an expression for the complement of x.
+func Not(x Expr) Expr {
+	return notExpr{x}
+}
+
+// And returns an expression for the intersection of xs.
+func And(xs ...Expr) Expr {
+	return newListExpr("And", opAnd, xs)
+}
+
+// Or returns an expression for the union of xs.
+func Or(xs ...Expr) Expr {
+	return newListExpr("Or", opOr, xs)
+}
+
+// Xor returns an expression for the exclusive-or of xs, which is true where
+// an odd number of xs are true.
+func Xor(xs ...Expr) Expr {
+	return newListExpr("Xor", opXor, xs)
+}
+
+func newListExpr(name string, op exprOp, xs []Expr) Expr {
+	if len(xs) == 0 {
+		panic(name + " requires at least one operand")
+	}
+	if len(xs) == 1 {
+		return xs[0]
+	}
+	return listExpr{op, append([]Expr(nil), xs...)}
+}
+
+func (x leafExpr) Len() uint64 { return x.ba.Len() }
+func (x notExpr) Len() uint64  { return x.x.Len() }
+func (x listExpr) Len() uint64 { return x.xs[0].Len() }
+
+func (x leafExpr) compile(c *exprCompiler) {
+	if x.ba.Len() != c.num {
+		panic("bit arrays are not equal in size")
+	}
+	for i, ba := range c.leaves {
+		if ba == x.ba {
+			c.emit(opLeaf, i)
+			return
+		}
+	}
+	c.leaves = append(c.leaves, x.ba)
+	c.emit(opLeaf, len(c.leaves)-1)
+}
+
+func (x notExpr) compile(c *exprCompiler) {
+	x.x.compile(c)
+	c.emit(opNot, 1)
+}
+
+func (x listExpr) compile(c *exprCompiler) {
+	for _, y := range x.xs {
+		y.compile(c)
+	}
+	c.emit(x.op, len(x.xs))
+}
+
+type exprInstr struct {
+	op  exprOp
+	arg int // the index of the leaf for opLeaf, else the number of operands
+}
+
+// exprCompiler flattens an expression into a program for a stack machine
+// which computes one 64-bit word of the result at a time.
+type exprCompiler struct {
+	num    uint64
+	leaves []BigBitVector
+	code   []exprInstr
+	stack  []uint64
+}
+
+func compileExpr(e Expr) *exprCompiler {
+	c := &exprCompiler{num: e.Len()}
+	e.compile(c)
+	c.stack = make([]uint64, 0, len(c.code))
+	return c
+}
+
+func (c *exprCompiler) emit(op exprOp, arg int) {
+	c.code = append(c.code, exprInstr{op, arg})
+}
+
+// eval runs the program over the words of the leaves, in leaf order.
+func (c *exprCompiler) eval(mask uint64, in []uint64) uint64 {
+	s := c.stack[:0]
+	for _, ins := range c.code {
+		switch ins.op {
+		case opLeaf:
+			s = append(s, in[ins.arg])
+		case opNot:
+			s[len(s)-1] = ^s[len(s)-1] & mask
+		default:
+			base := len(s) - ins.arg
+			v := s[base]
+			for _, w := range s[base+1:] {
+				switch ins.op {
+				case opAnd:
+					v &= w
+				case opOr:
+					v |= w
+				case opXor:
+					v ^= w
+				}
+			}
+			s = append(s[:base], v)
+		}
+	}
+	return s[0]
+}
+
+// run streams the leaves, storing the result into dst if it is not nil, and
+// calls fn with every word of the result.
+func (c *exprCompiler) run(dst BigBitVector, fn func(index, word uint64) error) error {
+	return streamWords(dst, c.leaves, func(index, mask uint64, in []uint64) (uint64, error) {
+		word := c.eval(mask, in)
+		if fn != nil {
+			if err := fn(index, word); err != nil {
+				return 0, err
+			}
+		}
+		return word, nil
+	})
+}
+
+// Materialize evaluates the expression and stores its value into dst, which
+// must have the same length.  dst may also appear as a leaf of the
+// expression.
+func Materialize(dst BigBitVector, e Expr) error {
+	if dst.Frozen() {
+		panic("BigBitVector is read-only")
+	}
+	c := compileExpr(e)
+	if dst.Len() != c.num {
+		panic("bit arrays are not equal in size")
+	}
+	return c.run(dst, nil)
+}
+
+// CountExpr evaluates the expression and returns the number of set bits in
+// its value.
+func CountExpr(e Expr) (uint64, error) {
+	var total uint64
+	err := compileExpr(e).run(nil, func(_, word uint64) error {
+		total += uint64(bits.OnesCount64(word))
+		return nil
+	})
+	return total, err
+}
+
+// ForEachExpr evaluates the expression and calls fn with the index of every
+// set bit in its value, in increasing order.  If fn returns an error, the
+// evaluation stops and returns it.
+func ForEachExpr(e Expr, fn func(uint64) error) error {
+	return compileExpr(e).run(nil, func(index, word uint64) error {
+		for word != 0 {
+			k := uint64(bits.TrailingZeros64(word))
+			if err := fn(index + k); err != nil {
+				return err
+			}
+			word &= word - 1
+		}
+		return nil
+	})
+}
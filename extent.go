@@ -0,0 +1,94 @@
+package bigbitvector
+
+import (
+	"sort"
+)
+
+// extent is a contiguous run of bytes within a File.
+type extent struct {
+	off uint64
+	len uint64
+}
+
+func (e extent) end() uint64 {
+	return e.off + e.len
+}
+
+// extentAllocator hands out extents of a File.  Released extents are kept on
+// a sorted, coalesced free list and reused first-fit; free space at the end
+// of the file is given back by lowering end.
+type extentAllocator struct {
+	free  []extent
+	start uint64
+	end   uint64
+}
+
+func newExtentAllocator(start uint64) extentAllocator {
+	return extentAllocator{start: start, end: start}
+}
+
+// rebuild reconstructs the free list from the set of extents still in use.
+func (a *extentAllocator) rebuild(used []extent) {
+	sorted := make([]extent, 0, len(used))
+	for _, e := range used {
+		if e.len != 0 {
+			sorted = append(sorted, e)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].off < sorted[j].off })
+
+	a.free = a.free[:0]
+	pos := a.start
+	for _, e := range sorted {
+		if e.off > pos {
+			a.free = append(a.free, extent{off: pos, len: e.off - pos})
+		}
+		if e.end() > pos {
+			pos = e.end()
+		}
+	}
+	a.end = pos
+}
+
+func (a *extentAllocator) alloc(n uint64) extent {
+	for i, e := range a.free {
+		if e.len < n {
+			continue
+		}
+		x := extent{off: e.off, len: n}
+		if e.len == n {
+			a.free = append(a.free[:i], a.free[i+1:]...)
+		} else {
+			a.free[i] = extent{off: e.off + n, len: e.len - n}
+		}
+		return x
+	}
+	x := extent{off: a.end, len: n}
+	a.end += n
+	return x
+}
+
+func (a *extentAllocator) release(x extent) {
+	if x.len == 0 {
+		return
+	}
+
+	i := sort.Search(len(a.free), func(i int) bool { return a.free[i].off > x.off })
+	if i > 0 && a.free[i-1].end() == x.off {
+		i--
+		x = extent{off: a.free[i].off, len: a.free[i].len + x.len}
+		a.free = append(a.free[:i], a.free[i+1:]...)
+	}
+	if i < len(a.free) && x.end() == a.free[i].off {
+		x.len += a.free[i].len
+		a.free = append(a.free[:i], a.free[i+1:]...)
+	}
+
+	if x.end() == a.end {
+		a.end = x.off
+		return
+	}
+	a.free = append(a.free, extent{})
+	copy(a.free[i+1:], a.free[i:])
+	a.free[i] = x
+}
@@ -0,0 +1,102 @@
+package bigbitvector
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// sortedOrder returns the positions of idx in order of increasing index, or
+// nil if idx is already sorted.
+func sortedOrder(idx []uint64) []int {
+	sorted := true
+	for k := 1; k < len(idx); k++ {
+		if idx[k] < idx[k-1] {
+			sorted = false
+			break
+		}
+	}
+	if sorted {
+		return nil
+	}
+	order := make([]int, len(idx))
+	for k := range order {
+		order[k] = k
+	}
+	sort.Slice(order, func(a, b int) bool { return idx[order[a]] < idx[order[b]] })
+	return order
+}
+
+// visitSorted calls fn with each position of idx, in order of increasing
+// index, so that indices on the same page are visited together.  It returns
+// io.EOF, without calling fn, if any index is out of range.
+func visitSorted(ba BigBitVector, idx []uint64, fn func(k int) error) error {
+	for _, index := range idx {
+		if index >= ba.Len() {
+			return io.EOF
+		}
+	}
+	order := sortedOrder(idx)
+	for k := range idx {
+		if order != nil {
+			k = order[k]
+		}
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gather reads the bits with the given indices into out, so that out[k] is
+// the bit with index idx[k].  The indices may be in any order and may repeat.
+// They are visited in sorted order and grouped by page, so that on-disk
+// bitvectors read each page they touch once, instead of once per index as
+// BitAt does.  Sorted input is detected and not sorted again.
+//
+// Gather returns io.EOF, and reads nothing, if any index is out of range.
+//
+func Gather(ba BigBitVector, idx []uint64, out []bool) error {
+	if len(out) < len(idx) {
+		panic(fmt.Errorf("Gather: out too small: %d bools for %d indices", len(out), len(idx)))
+	}
+	c := newByteCursor(ba)
+	err := visitSorted(ba, idx, func(k int) error {
+		b, m := byteAndMask(idx[k])
+		p, err := c.at(b)
+		if err != nil {
+			return err
+		}
+		out[k] = (*p & m) != 0
+		return nil
+	})
+	return c.close(err)
+}
+
+// Scatter sets the bits with the given indices to bit.  Like Gather, it
+// groups the indices by page, so that on-disk bitvectors read and write each
+// page they touch once.
+//
+// Scatter returns io.EOF, and writes nothing, if any index is out of range.
+//
+func Scatter(ba BigBitVector, idx []uint64, bit bool) error {
+	if ba.Frozen() {
+		panic("BigBitVector is read-only")
+	}
+	c := newByteCursor(ba)
+	err := visitSorted(ba, idx, func(k int) error {
+		b, m := byteAndMask(idx[k])
+		p, err := c.at(b)
+		if err != nil {
+			return err
+		}
+		if bit {
+			*p |= m
+		} else {
+			*p &= ^m
+		}
+		c.pc.markDirty()
+		return nil
+	})
+	return c.close(err)
+}
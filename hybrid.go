@@ -0,0 +1,367 @@
+package bigbitvector
+
+import (
+	"context"
+	"fmt"
+)
+
+// hybridCheckInterval is the number of bit accesses between polls of the
+// memory budget.
+const hybridCheckInterval = 65536
+
+type hybridArray struct {
+	cur   BigBitVector
+	o     options
+	iters map[*hybridIterator]struct{}
+	ops   uint64
+}
+
+func newHybridArray(o options) (*hybridArray, error) {
+	o.isHybrid = false
+	cur, err := newWithOptions(o)
+	if err != nil {
+		return nil, err
+	}
+	bv := &hybridArray{
+		cur:   cur,
+		o:     o,
+		iters: make(map[*hybridIterator]struct{}),
+	}
+	return bv, nil
+}
+
+func (bv *hybridArray) Frozen() bool {
+	return bv.cur.Frozen()
+}
+
+func (bv *hybridArray) Len() uint64 {
+	return bv.cur.Len()
+}
+
+func (bv *hybridArray) BitAt(index uint64) (bool, error) {
+	if err := bv.tick(1); err != nil {
+		return false, err
+	}
+	return bv.cur.BitAt(index)
+}
+
+func (bv *hybridArray) SetBitAt(index uint64, bit bool) error {
+	if err := bv.tick(1); err != nil {
+		return err
+	}
+	return bv.cur.SetBitAt(index, bit)
+}
+
+func (bv *hybridArray) Iterate(i, j uint64) Iterator {
+	if i > j {
+		panic(fmt.Errorf("hybridArray.Iterate: i > j: i=%d j=%d", i, j))
+	}
+	return bv.newIterator(i, j, false)
+}
+
+func (bv *hybridArray) ReverseIterate(i, j uint64) Iterator {
+	if i > j {
+		panic(fmt.Errorf("hybridArray.ReverseIterate: i > j: i=%d j=%d", i, j))
+	}
+	return bv.newIterator(i, j, true)
+}
+
+func (bv *hybridArray) CopyFrom(src BigBitVector) error {
+	return bv.cur.CopyFrom(src)
+}
+
+func (bv *hybridArray) Truncate(n uint64) error {
+	if err := bv.cur.Truncate(n); err != nil {
+		return err
+	}
+	if _, ok := bv.cur.(*onDiskArray); ok && !bv.tooBig() {
+		return bv.migrate(false)
+	}
+	return nil
+}
+
+func (bv *hybridArray) Freeze() error {
+	return bv.cur.Freeze()
+}
+
+func (bv *hybridArray) Flush() error {
+	return bv.cur.Flush()
+}
+
+func (bv *hybridArray) Close() error {
+	if len(bv.iters) != 0 {
+		panic("BigBitVector.Close called with outstanding iterators")
+	}
+	return bv.cur.Close()
+}
+
+func (bv *hybridArray) Debug() string {
+	return bv.cur.Debug()
+}
+
+func (bv *hybridArray) Verify() error {
+	return Verify(bv.cur)
+}
+
+func (bv *hybridArray) count() (uint64, error) {
+	return Count(bv.cur)
+}
+
+// OnDisk returns true if the bitvector currently lives in a temporary file.
+func (bv *hybridArray) OnDisk() bool {
+	_, ok := bv.cur.(*onDiskArray)
+	return ok
+}
+
+func (bv *hybridArray) tooBig() bool {
+	numBytes := (bv.Len() + 7) / 8
+	if numBytes >= bv.o.diskThreshold {
+		return true
+	}
+	return bv.o.memoryBudget != nil && bv.o.memoryBudget()
+}
+
+// tick accounts for n bit accesses, and periodically checks whether an
+// in-memory bitvector ought to be spilled to disk.
+func (bv *hybridArray) tick(n uint64) error {
+	bv.ops += n
+	if bv.ops < hybridCheckInterval {
+		return nil
+	}
+	bv.ops = 0
+	if _, ok := bv.cur.(*inMemoryArray); ok && bv.tooBig() {
+		return bv.migrate(true)
+	}
+	return nil
+}
+
+// migrate moves the bits to disk (or back into memory), suspending and then
+// resuming every live iterator around the switch.
+func (bv *hybridArray) migrate(toDisk bool) error {
+	for iter := range bv.iters {
+		iter.suspend()
+	}
+	defer func() {
+		for iter := range bv.iters {
+			iter.resume()
+		}
+	}()
+
+	o := bv.o
+	if toDisk {
+		o.diskThreshold = 0
+	} else {
+		o.diskThreshold = ^uint64(0)
+	}
+	o.numValues = bv.Len()
+	o.isReadOnly = false
+
+	next, err := newWithOptions(o)
+	if err != nil {
+		return err
+	}
+	if err := copyBytes(next, bv.cur); err != nil {
+		next.Close()
+		return err
+	}
+	if bv.cur.Frozen() {
+		if err := next.Freeze(); err != nil {
+			next.Close()
+			return err
+		}
+	}
+
+	prev := bv.cur
+	bv.cur = next
+	return prev.Close()
+}
+
+// copyBytes copies the packed bits between an in-memory and an on-disk
+// bitvector of the same length, one page at a time.
+func copyBytes(dst, src BigBitVector) error {
+	switch x := src.(type) {
+	case *inMemoryArray:
+		if y, ok := dst.(*onDiskArray); ok {
+			return y.forEachPage(true, func(page *cachePage) {
+				copy(page.data, x.data[page.off:])
+			})
+		}
+	case *onDiskArray:
+		if y, ok := dst.(*inMemoryArray); ok {
+			return x.forEachPage(false, func(page *cachePage) {
+				copy(y.data[page.off:], page.data)
+			})
+		}
+	}
+	return copyFromImpl(dst, src)
+}
+
+// forEachPage calls fn for each page of the file in turn.  If dirty is true,
+// each page is written back afterward.
+func (bv *onDiskArray) forEachPage(dirty bool, fn func(*cachePage)) error {
+	psz := uint64(bv.psz)
+	numBytes := (bv.num + 7) / 8
+	for off := uint64(0); off < numBytes; off += psz {
+		page, err := bv.acquirePage(off)
+		if err != nil {
+			return err
+		}
+		fn(page)
+		if dirty {
+			page.markDirty()
+			err = flushPage(bv, page)
+		}
+		bv.disposePage(page)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ BigBitVector = (*hybridArray)(nil)
+
+type hybridIterator struct {
+	bv    *hybridArray
+	inner Iterator
+	ctx   context.Context
+	err   error
+	i     uint64
+	j     uint64
+	steps uint64
+	down  bool
+	done  bool
+}
+
+func (bv *hybridArray) newIterator(i, j uint64, down bool) *hybridIterator {
+	iter := &hybridIterator{
+		bv:   bv,
+		i:    i,
+		j:    j,
+		down: down,
+	}
+	iter.resume()
+	bv.iters[iter] = struct{}{}
+	return iter
+}
+
+func (iter *hybridIterator) Err() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	if iter.inner == nil {
+		return nil
+	}
+	return iter.inner.Err()
+}
+
+func (iter *hybridIterator) Next() bool      { return iter.Skip(1) }
+func (iter *hybridIterator) Index() uint64   { return iter.inner.Index() }
+func (iter *hybridIterator) Bit() bool       { return iter.inner.Bit() }
+func (iter *hybridIterator) SetBit(bit bool) { iter.inner.SetBit(bit) }
+
+func (iter *hybridIterator) Skip(n uint64) bool {
+	if iter.err != nil || iter.done {
+		return false
+	}
+	if err := iter.bv.tick(n); err != nil {
+		iter.err = err
+		return false
+	}
+	if iter.err != nil {
+		return false
+	}
+	if !iter.inner.Skip(n) {
+		iter.done = true
+		return false
+	}
+	iter.steps += n
+	return true
+}
+
+func (iter *hybridIterator) Flush() error {
+	if iter.inner == nil {
+		return nil
+	}
+	return iter.inner.Flush()
+}
+
+func (iter *hybridIterator) Close() error {
+	if _, live := iter.bv.iters[iter]; !live {
+		return ErrClosedIterator
+	}
+	delete(iter.bv.iters, iter)
+	err := iter.Flush()
+	if iter.inner != nil {
+		if err2 := iter.inner.Close(); err == nil {
+			err = err2
+		}
+	}
+	if iter.err != nil {
+		err = iter.err
+	}
+	*iter = hybridIterator{bv: iter.bv, err: ErrClosedIterator}
+	return err
+}
+
+func (iter *hybridIterator) Reset(i, j uint64, reverse bool) error {
+	if i > j {
+		panic(fmt.Errorf("hybridIterator.Reset: i > j: i=%d j=%d", i, j))
+	}
+	var err error
+	inner := iter.inner
+	if inner != nil {
+		err = inner.Reset(i, j, reverse)
+	}
+	*iter = hybridIterator{
+		bv:    iter.bv,
+		inner: inner,
+		ctx:   iter.ctx,
+		i:     i,
+		j:     j,
+		down:  reverse,
+	}
+	iter.resume()
+	iter.bv.iters[iter] = struct{}{}
+	return err
+}
+
+// suspend releases the underlying iterator ahead of a migration.
+func (iter *hybridIterator) suspend() {
+	if iter.inner == nil {
+		return
+	}
+	if err := iter.inner.Close(); err != nil && iter.err == nil {
+		iter.err = err
+	}
+	iter.inner = nil
+}
+
+// resume reopens the underlying iterator at the position it was suspended.
+func (iter *hybridIterator) resume() {
+	if iter.inner != nil {
+		return
+	}
+	if iter.down {
+		iter.inner = iter.bv.cur.ReverseIterate(iter.i, iter.j)
+	} else {
+		iter.inner = iter.bv.cur.Iterate(iter.i, iter.j)
+	}
+	if b, ok := iter.inner.(contextBinder); ok && iter.ctx != nil {
+		b.bindContext(iter.ctx)
+	}
+	if iter.steps != 0 && !iter.done && !iter.inner.Skip(iter.steps) && iter.err == nil {
+		iter.err = iter.inner.Err()
+	}
+}
+
+// bindContext binds the underlying iterator to ctx, and any that replaces it
+// after a migration.
+func (iter *hybridIterator) bindContext(ctx context.Context) {
+	iter.ctx = ctx
+	if b, ok := iter.inner.(contextBinder); ok {
+		b.bindContext(ctx)
+	}
+}
+
+var _ Iterator = (*hybridIterator)(nil)
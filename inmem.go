@@ -203,8 +203,21 @@ func (iter *inMemoryIterator) Flush() error {
 
 func (iter *inMemoryIterator) Close() error {
 	err := iter.err
-	*iter = inMemoryIterator{err: ErrClosedIterator}
+	*iter = inMemoryIterator{bv: iter.bv, err: ErrClosedIterator}
 	return err
 }
 
+func (iter *inMemoryIterator) Reset(i, j uint64, reverse bool) error {
+	if i > j {
+		panic(fmt.Errorf("inMemoryIterator.Reset: i > j: i=%d j=%d", i, j))
+	}
+	*iter = inMemoryIterator{
+		bv:   iter.bv,
+		base: i,
+		num:  (j - i),
+		down: reverse,
+	}
+	return nil
+}
+
 var _ Iterator = (*inMemoryIterator)(nil)
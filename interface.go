@@ -102,6 +102,15 @@ type Iterator interface {
 
 	// Close flushes writes and frees the resources used by the iterator.
 	Close() error
+
+	// Reset flushes writes, then rewinds the iterator to cover indices (i)
+	// through (j-1), in reverse order if reverse is true, as though it had
+	// just been returned by Iterate or ReverseIterate.  Reset may also be
+	// called on a closed iterator, which makes it usable again.
+	//
+	// Reusing an iterator this way avoids allocating a new one for every
+	// scan.
+	Reset(i, j uint64, reverse bool) error
 }
 
 // New constructs a BigBitVector instance.
@@ -113,6 +122,27 @@ func New(opts ...Option) (BigBitVector, error) {
 	var o options
 	o.apply(opts...)
 	o.populate()
+	return newWithOptions(o)
+}
+
+func newWithOptions(o options) (BigBitVector, error) {
+	type sizer interface{ Size() uint64 }
+
+	if o.isAtomic && o.backingFile == nil {
+		return newAtomicArray(o.numValues, o.isReadOnly), nil
+	}
+
+	if o.isSparse && o.backingFile == nil {
+		return newSparseArray(o.numValues, o.diskThreshold, o.isReadOnly), nil
+	}
+
+	if o.isAdaptive && o.backingFile == nil {
+		return newAdaptiveArray(o.numValues, o.diskThreshold, o.isReadOnly), nil
+	}
+
+	if o.isHybrid && o.backingFile == nil {
+		return newHybridArray(o)
+	}
 
 	numBytes := (o.numValues + 7) / 8
 	if o.backingFile == nil && numBytes < o.diskThreshold {
@@ -124,6 +154,12 @@ func New(opts ...Option) (BigBitVector, error) {
 		return ba, nil
 	}
 
+	if o.usePageLocks && (o.encryptionKey != nil || o.codec != 0) {
+		// Their headers and page tables are shared by every page, so
+		// locking pages alone would not keep processes apart.
+		return nil, errors.New("PageLocking cannot be combined with Encrypted or Compressed")
+	}
+
 	doc := false
 	if o.backingFile == nil {
 		var err error
@@ -131,22 +167,124 @@ func New(opts ...Option) (BigBitVector, error) {
 		if err != nil {
 			return nil, err
 		}
-		err = o.backingFile.Truncate(int64(numBytes))
+		doc = true
+	}
+
+	dck := false
+	if o.useChecksums && o.checksumFile == nil {
+		var err error
+		o.checksumFile, err = ioutil.TempFile("", "tmp")
 		if err != nil {
-			removeFile(o.backingFile)
+			if doc {
+				closeFile(o.backingFile, doc)
+			}
+			return nil, err
+		}
+		dck = true
+	}
+
+	// cleanup undoes the work done so far after a failure.  Files which
+	// the caller supplied are left open: they aren't ours to close, and
+	// closing one would drop every lock this process holds on it.
+	var lf File
+	cleanup := func() {
+		if lf != nil {
+			unlockRange(lf, 0, 0)
+		}
+		if doc {
+			closeFile(o.backingFile, doc)
+		}
+		if dck {
+			closeFile(o.checksumFile, dck)
+		}
+	}
+
+	if o.useLocking && !doc {
+		if err := lockFile(o.backingFile, o.usePageLocks, !o.isReadOnly); err != nil {
+			cleanup()
+			return nil, err
+		}
+		lf = o.backingFile
+	}
+
+	needTruncate := doc
+	if o.encryptionKey != nil {
+		ef, err := newEncryptedFile(o.backingFile, o.encryptionKey, o.pageSize)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		o.backingFile = ef
+
+		if o.checksumFile != nil {
+			ef, err = newEncryptedFile(o.checksumFile, o.encryptionKey, o.pageSize)
+			if err != nil {
+				cleanup()
+				return nil, err
+			}
+			o.checksumFile = ef
+		}
+	}
+
+	if o.codec != 0 {
+		cf, err := newCompressedFile(o.backingFile, o.codec, o.pageSize, o.isReadOnly)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		o.backingFile = cf
+	}
+
+	if sf, ok := o.backingFile.(sizer); ok {
+		needTruncate = !o.isReadOnly && sf.Size() < numBytes
+	}
+
+	if needTruncate {
+		err := o.backingFile.Truncate(int64(numBytes))
+		if err != nil {
+			cleanup()
 			return nil, err
 		}
-		doc = true
 	}
 
 	ba := &onDiskArray{
 		f:     o.backingFile,
 		p:     o.bufferPool,
+		pc:    o.pageCache,
+		ck:    o.checksumFile,
 		cache: make(map[uint64]*cachePage),
 		num:   o.numValues,
 		psz:   o.pageSize,
+		lf:    lf,
+		ra:    o.readAhead,
 		ro:    o.isReadOnly,
 		doc:   doc,
+		dck:   dck,
+	}
+
+	if dck && !doc {
+		// The caller's file may already hold data, which the new
+		// side table must vouch for.
+		if err := ba.seedChecksums(); err != nil {
+			cleanup()
+			return nil, err
+		}
+	}
+
+	psz := uint64(o.pageSize)
+	if lf != nil && o.usePageLocks {
+		// Other processes may change any page which isn't locked, so
+		// nothing is remembered about pages once they leave the cache.
+		ba.pl = true
+		ba.ra = 0
+		ba.uni = newUniformMap(0)
+		return ba, nil
+	}
+	ba.uni = newUniformMap((numBytes + psz - 1) / psz)
+	if doc {
+		ba.uni.markAllZero()
+	} else {
+		scanHoles(o.backingFile, numBytes, ba.markZeroRange)
 	}
 	return ba, nil
 }
@@ -0,0 +1,83 @@
+package bigbitvector
+
+import (
+	"fmt"
+)
+
+// lockSentinel is the offset of the byte that page-locking processes lock
+// shared, so that they conflict with a process holding a whole-file
+// exclusive lock.  It lies far beyond the end of any real bitvector.
+const lockSentinel = 1 << 62
+
+// LockError is returned when another process holds a conflicting lock on a
+// bitvector's file.
+type LockError struct {
+	// Path is the name of the locked file.
+	Path string
+
+	// Start and Len give the byte range of the conflicting lock.  A Len
+	// of 0 means that the lock extends to the end of the file.
+	Start int64
+	Len   int64
+
+	// PID identifies the process holding the conflicting lock, or is 0 if
+	// it could not be determined.
+	PID int
+
+	// Exclusive is true if the conflicting lock is held for writing.
+	Exclusive bool
+}
+
+func (err *LockError) Error() string {
+	var region string
+	switch {
+	case err.Start == 0 && err.Len == 0:
+		region = "the whole file is"
+	case err.Start == lockSentinel:
+		region = "the page-locking marker of the file is"
+	case err.Len == 0:
+		region = fmt.Sprintf("bytes %d onward are", err.Start)
+	default:
+		region = fmt.Sprintf("bytes %d through %d are", err.Start, err.Start+err.Len-1)
+	}
+	kind := "shared"
+	if err.Exclusive {
+		kind = "exclusive"
+	}
+	holder := "another process"
+	if err.PID > 0 {
+		holder = fmt.Sprintf("process %d", err.PID)
+	}
+	return fmt.Sprintf("%s: %s locked (%s) by %s", err.Path, region, kind, holder)
+}
+
+// lockFile takes the lock that New acquires on a file: a lock on the whole
+// file, or with page locking, a shared lock on the sentinel byte.
+func lockFile(file File, pages, write bool) error {
+	if pages {
+		return lockRange(file, lockSentinel, 1, false)
+	}
+	return lockRange(file, 0, 0, write)
+}
+
+// lockPage locks page off for as long as it stays in the cache, if page
+// locking is enabled.
+func (bv *onDiskArray) lockPage(off uint64) error {
+	if !bv.pl {
+		return nil
+	}
+	return lockRange(bv.lf, int64(off), int64(bv.psz), !bv.ro)
+}
+
+func (bv *onDiskArray) unlockPage(off uint64) {
+	if bv.pl {
+		unlockRange(bv.lf, int64(off), int64(bv.psz))
+	}
+}
+
+// unlockFile releases every lock held on the file.
+func (bv *onDiskArray) unlockFile() {
+	if bv.lf != nil {
+		unlockRange(bv.lf, 0, 0)
+	}
+}
@@ -0,0 +1,50 @@
+package bigbitvector
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockRange takes a POSIX advisory lock on the byte range [start, start+n) of
+// file without waiting, or on everything from start onward if n is 0.  If
+// another process holds a conflicting lock, it returns a *LockError
+// describing that lock.
+func lockRange(file File, start, n int64, write bool) error {
+	f := rawOSFile(file)
+	if f == nil {
+		return &NotImplementedError{Op: "Locking"}
+	}
+	typ := int16(syscall.F_RDLCK)
+	if write {
+		typ = syscall.F_WRLCK
+	}
+	lk := syscall.Flock_t{Type: typ, Whence: io.SeekStart, Start: start, Len: n}
+	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+	if err == nil {
+		return nil
+	}
+	if err != syscall.EAGAIN && err != syscall.EACCES {
+		return &os.PathError{Op: "fcntl", Path: f.Name(), Err: err}
+	}
+
+	lerr := &LockError{Path: f.Name(), Start: start, Len: n, Exclusive: true}
+	lk = syscall.Flock_t{Type: typ, Whence: io.SeekStart, Start: start, Len: n}
+	if syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lk) == nil && lk.Type != syscall.F_UNLCK {
+		lerr.Start = lk.Start
+		lerr.Len = lk.Len
+		lerr.PID = int(lk.Pid)
+		lerr.Exclusive = (lk.Type == syscall.F_WRLCK)
+	}
+	return lerr
+}
+
+// unlockRange releases any lock held on the byte range [start, start+n).
+func unlockRange(file File, start, n int64) {
+	f := rawOSFile(file)
+	if f == nil {
+		return
+	}
+	lk := syscall.Flock_t{Type: syscall.F_UNLCK, Whence: io.SeekStart, Start: start, Len: n}
+	syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+}
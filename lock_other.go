@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package bigbitvector
+
+func lockRange(file File, start, n int64, write bool) error {
+	return &NotImplementedError{Op: "Locking"}
+}
+
+func unlockRange(file File, start, n int64) {
+}
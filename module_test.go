@@ -1,6 +1,15 @@
 package bigbitvector
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
 	"sync"
 	"testing"
 )
@@ -94,3 +103,2303 @@ func TestBitVector_OnDisk_WithPool(t *testing.T) {
 		OnDiskThreshold(0),
 		WithPool(pool))
 }
+
+func TestBitVector_OnDisk_DirtyUniformPage(t *testing.T) {
+	ba, err := New(PageSize(32), NumValues(1024), OnDiskThreshold(0))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+
+	// The page is all zeroes on disk, but the iterator's cached copy is
+	// not, so clearing the bit must still reach the cached copy.
+	iter := ba.Iterate(0, ba.Len())
+	if !iter.Next() {
+		t.Fatalf("Iterator.Next: error: %v", iter.Err())
+	}
+	iter.SetBit(true)
+	if err := ba.SetBitAt(0, false); err != nil {
+		t.Errorf("BigBitVector.SetBitAt: error: %v", err)
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("Iterator.Close: error: %v", err)
+	}
+	if bit, err := ba.BitAt(0); err != nil || bit {
+		t.Errorf("BigBitVector.BitAt 0: expected false, got %v (error: %v)", bit, err)
+	}
+}
+
+func TestBitVector_OnDisk_Checksums(t *testing.T) {
+	RunBitVectorBasicTests(t,
+		PageSize(32),
+		OnDiskThreshold(0),
+		WithChecksums(nil))
+}
+
+func TestBitVector_OnDisk_Corruption(t *testing.T) {
+	f, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if err := f.Truncate(128); err != nil {
+		t.Fatalf("Truncate: error: %v", err)
+	}
+
+	ba, err := New(
+		PageSize(32),
+		NumValues(1024),
+		WithFile(f),
+		WithChecksums(nil))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+
+	if err := ba.SetBitAt(300, true); err != nil {
+		t.Errorf("BigBitVector.SetBitAt 300: error: %v", err)
+	}
+	if err := Verify(ba); err != nil {
+		t.Errorf("Verify [1/2]: error: %v", err)
+	}
+
+	if _, err := f.WriteAt([]byte{0xff}, 40); err != nil {
+		t.Fatalf("WriteAt: error: %v", err)
+	}
+
+	_, err = ba.BitAt(300)
+	if cerr, ok := err.(*CorruptionError); !ok || cerr.Offset != 32 {
+		t.Errorf("BigBitVector.BitAt 300: expected CorruptionError at 32, got %v", err)
+	}
+	if _, ok := Verify(ba).(*CorruptionError); !ok {
+		t.Error("Verify [2/2]: expected CorruptionError")
+	}
+	if _, err := ba.BitAt(0); err != nil {
+		t.Errorf("BigBitVector.BitAt 0: error: %v", err)
+	}
+}
+
+func TestBitVector_OnDisk_MissingChecksum(t *testing.T) {
+	ck, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(ck.Name())
+	defer ck.Close()
+
+	ba, err := New(PageSize(32), NumValues(1024), OnDiskThreshold(0), WithChecksums(ck))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+
+	if err := ba.SetBitAt(300, true); err != nil {
+		t.Errorf("BigBitVector.SetBitAt 300: error: %v", err)
+	}
+	if err := Verify(ba); err != nil {
+		t.Errorf("Verify [1/2]: error: %v", err)
+	}
+
+	// Page 1 has been flushed, so a blank entry for it is corruption.
+	if _, err := ck.WriteAt(make([]byte, checksumSize), checksumSize); err != nil {
+		t.Fatalf("WriteAt: error: %v", err)
+	}
+	_, err = ba.BitAt(300)
+	if cerr, ok := err.(*CorruptionError); !ok || cerr.Offset != 32 || !cerr.Missing {
+		t.Errorf("BigBitVector.BitAt 300: expected missing checksum at 32, got %v", err)
+	}
+	if _, ok := Verify(ba).(*CorruptionError); !ok {
+		t.Error("Verify [2/2]: expected CorruptionError")
+	}
+	if _, err := ba.BitAt(0); err != nil {
+		t.Errorf("BigBitVector.BitAt 0: error: %v", err)
+	}
+}
+
+func TestBitVector_OnDisk_SeededChecksums(t *testing.T) {
+	f, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := f.Truncate(128); err != nil {
+		t.Fatalf("Truncate: error: %v", err)
+	}
+	if _, err := f.WriteAt([]byte{0x01, 0x80}, 40); err != nil {
+		t.Fatalf("WriteAt: error: %v", err)
+	}
+
+	// A fresh side table for existing data must not report it as corrupt.
+	ba, err := New(PageSize(32), NumValues(1024), WithReadOnlyFile(f), WithChecksums(nil))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+	if bit, err := ba.BitAt(320); err != nil || !bit {
+		t.Errorf("BigBitVector.BitAt 320: expected true, got %v (error: %v)", bit, err)
+	}
+	if err := Verify(ba); err != nil {
+		t.Errorf("Verify [1/2]: error: %v", err)
+	}
+
+	if _, err := f.WriteAt([]byte{0xff}, 40); err != nil {
+		t.Fatalf("WriteAt: error: %v", err)
+	}
+	if _, ok := Verify(ba).(*CorruptionError); !ok {
+		t.Error("Verify [2/2]: expected CorruptionError")
+	}
+}
+
+func TestBitVector_OnDisk_Encrypted(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	RunBitVectorBasicTests(t,
+		PageSize(32),
+		OnDiskThreshold(0),
+		Encrypted(key),
+		WithChecksums(nil))
+
+	f, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	ba, err := New(PageSize(32), NumValues(1024), WithFile(f), Encrypted(key))
+	if err != nil {
+		t.Fatalf("New [1/3]: error: %v", err)
+	}
+	iter := ba.Iterate(0, ba.Len())
+	for iter.Next() {
+		iter.SetBit(iter.Index()%3 == 0)
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("Iterator.Close: error: %v", err)
+	}
+	if err := ba.Close(); err != nil {
+		t.Errorf("BigBitVector.Close: error: %v", err)
+	}
+
+	f, err = os.Open(f.Name())
+	if err != nil {
+		t.Fatalf("Open: error: %v", err)
+	}
+	defer f.Close()
+
+	ba, err = New(PageSize(32), NumValues(1024), WithReadOnlyFile(f), Encrypted(key))
+	if err != nil {
+		t.Fatalf("New [2/3]: error: %v", err)
+	}
+	err = ForEach(ba, func(index uint64, bit bool) error {
+		if bit != (index%3 == 0) {
+			t.Errorf("%d: expected %v, got %v", index, !bit, bit)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("ForEach: error: %v", err)
+	}
+	ba.Close()
+
+	ba, err = New(PageSize(32), NumValues(1024), WithReadOnlyFile(f), Encrypted([]byte("fedcba9876543210")))
+	if err != nil {
+		t.Fatalf("New [3/3]: error: %v", err)
+	}
+	if _, err := ba.BitAt(0); err == nil {
+		t.Error("BigBitVector.BitAt 0: expected error with wrong key")
+	}
+	ba.Close()
+}
+
+func TestEncryptedFile_TruncateNonce(t *testing.T) {
+	f, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	ef, err := newEncryptedFile(f, []byte("0123456789abcdef"), 32)
+	if err != nil {
+		t.Fatalf("newEncryptedFile: error: %v", err)
+	}
+	page := bytes.Repeat([]byte{0xa5}, 32)
+	for pass := 0; pass < 2; pass++ {
+		if _, err := ef.WriteAt(page, 3*32); err != nil {
+			t.Fatalf("WriteAt: error: %v", err)
+		}
+	}
+	if err := ef.Truncate(32); err != nil {
+		t.Fatalf("Truncate: error: %v", err)
+	}
+	if err := ef.Truncate(4 * 32); err != nil {
+		t.Fatalf("Truncate: error: %v", err)
+	}
+	if _, err := ef.WriteAt(page, 3*32); err != nil {
+		t.Fatalf("WriteAt: error: %v", err)
+	}
+	gen, err := ef.readGen(3)
+	if err != nil {
+		t.Fatalf("readGen: error: %v", err)
+	}
+	if gen <= 2 {
+		t.Errorf("expected a fresh generation after truncation, got %d", gen)
+	}
+
+	// The floor must survive reopening the file.
+	ef, err = newEncryptedFile(f, []byte("0123456789abcdef"), 32)
+	if err != nil {
+		t.Fatalf("newEncryptedFile: error: %v", err)
+	}
+	if ef.floor < 2 {
+		t.Errorf("expected generation floor of at least 2, got %d", ef.floor)
+	}
+	buf := make([]byte, 32)
+	if _, err := ef.ReadAt(buf, 3*32); err != nil {
+		t.Fatalf("ReadAt: error: %v", err)
+	}
+	if !bytes.Equal(buf, page) {
+		t.Errorf("expected %x, got %x", page, buf)
+	}
+}
+
+func TestEncryptedFile_ConcurrentWrites(t *testing.T) {
+	f, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	ef, err := newEncryptedFile(f, []byte("0123456789abcdef"), 32)
+	if err != nil {
+		t.Fatalf("newEncryptedFile: error: %v", err)
+	}
+
+	// Each writer updates its own byte of the same page.
+	var wg sync.WaitGroup
+	for k := 0; k < 32; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			for pass := 0; pass < 8; pass++ {
+				if _, err := ef.WriteAt([]byte{byte(k + pass)}, int64(k)); err != nil {
+					t.Errorf("WriteAt %d: error: %v", k, err)
+				}
+			}
+		}(k)
+	}
+	wg.Wait()
+
+	gen, err := ef.readGen(0)
+	if err != nil || gen != 32*8 {
+		t.Errorf("readGen: expected %d, got %d (error: %v)", 32*8, gen, err)
+	}
+	buf := make([]byte, 32)
+	if _, err := ef.ReadAt(buf, 0); err != nil {
+		t.Fatalf("ReadAt: error: %v", err)
+	}
+	for k, b := range buf {
+		if b != byte(k+7) {
+			t.Errorf("%d: expected %d, got %d", k, k+7, b)
+		}
+	}
+}
+
+func TestNew_FailureKeepsCallerFiles(t *testing.T) {
+	f, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	ck, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(ck.Name())
+	defer ck.Close()
+
+	// A key of the wrong size fails after both files have been taken on.
+	_, err = New(PageSize(32), NumValues(1024), WithFile(f), WithChecksums(ck), Encrypted([]byte("short")))
+	if err == nil {
+		t.Fatal("New: expected error")
+	}
+	for _, x := range []*os.File{f, ck} {
+		if _, err := x.Stat(); err != nil {
+			t.Errorf("Stat %s: expected the file to stay open, got %v", x.Name(), err)
+		}
+	}
+}
+
+func TestBitVector_OnDisk_Compressed(t *testing.T) {
+	for _, codec := range []Codec{CodecFlate, CodecRLE} {
+		RunBitVectorBasicTests(t,
+			PageSize(32),
+			OnDiskThreshold(0),
+			Compressed(codec))
+
+		f, err := ioutil.TempFile("", "tmp")
+		if err != nil {
+			t.Fatalf("TempFile: error: %v", err)
+		}
+		defer os.Remove(f.Name())
+
+		ba, err := New(PageSize(32), NumValues(4096), WithFile(f), Compressed(codec))
+		if err != nil {
+			t.Fatalf("%v: New [1/2]: error: %v", codec, err)
+		}
+		for pass := 0; pass < 3; pass++ {
+			iter := ba.Iterate(0, ba.Len())
+			for iter.Next() {
+				index := iter.Index()
+				iter.SetBit(index >= 1000 && index < 1200 && index%(uint64(pass)+2) == 0)
+			}
+			if err := iter.Close(); err != nil {
+				t.Errorf("%v: Iterator.Close: error: %v", codec, err)
+			}
+		}
+		if err := ba.Close(); err != nil {
+			t.Errorf("%v: BigBitVector.Close: error: %v", codec, err)
+		}
+
+		fi, err := os.Stat(f.Name())
+		if err != nil {
+			t.Fatalf("Stat: error: %v", err)
+		}
+		if fi.Size() >= 512 {
+			t.Errorf("%v: expected compressed file smaller than 512 bytes, got %d", codec, fi.Size())
+		}
+
+		f, err = os.Open(f.Name())
+		if err != nil {
+			t.Fatalf("Open: error: %v", err)
+		}
+		defer f.Close()
+
+		ba, err = New(PageSize(32), NumValues(4096), WithReadOnlyFile(f), Compressed(codec))
+		if err != nil {
+			t.Fatalf("%v: New [2/2]: error: %v", codec, err)
+		}
+		err = ReverseForEach(ba, func(index uint64, bit bool) error {
+			if expect := index >= 1000 && index < 1200 && index%4 == 0; bit != expect {
+				t.Errorf("%v: %d: expected %v, got %v", codec, index, expect, bit)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%v: ReverseForEach: error: %v", codec, err)
+		}
+		ba.Close()
+	}
+}
+
+func TestCompressedFile_UnknownCodec(t *testing.T) {
+	f, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cf, err := newCompressedFile(f, CodecRLE, 32, false)
+	if err != nil {
+		t.Fatalf("newCompressedFile: error: %v", err)
+	}
+	if _, err := cf.WriteAt(bytes.Repeat([]byte{0x5a}, 32), 0); err != nil {
+		t.Fatalf("WriteAt: error: %v", err)
+	}
+	if err := cf.Flush(); err != nil {
+		t.Fatalf("Flush: error: %v", err)
+	}
+
+	// A page can't be decoded with a codec the file doesn't know.
+	cf.codec = Codec(9)
+	if err := cf.readPage(0, make([]byte, 32)); err == nil {
+		t.Error("readPage: expected error with unknown codec")
+	}
+
+	if _, err := f.WriteAt([]byte{9}, 40); err != nil {
+		t.Fatalf("WriteAt: error: %v", err)
+	}
+	if _, err := newCompressedFile(f, CodecRLE, 32, false); err == nil {
+		t.Error("newCompressedFile: expected error with unknown codec in header")
+	}
+}
+
+func TestBitVector_Count(t *testing.T) {
+	for _, opt := range []Option{OnDiskThreshold(1 << 20), OnDiskThreshold(0)} {
+		ba, err := New(PageSize(32), NumValues(1000), opt)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+
+		iter := ba.Iterate(256, 768)
+		for iter.Next() {
+			iter.SetBit(true)
+		}
+		if err := iter.Close(); err != nil {
+			t.Errorf("Iterator.Close: error: %v", err)
+		}
+		ba.SetBitAt(999, true)
+		ba.SetBitAt(300, false)
+
+		n, err := Count(ba)
+		if err != nil {
+			t.Errorf("Count: error: %v", err)
+		}
+		if n != 512 {
+			t.Errorf("Count: expected 512, got %d", n)
+		}
+
+		if err := ba.Truncate(997); err != nil {
+			t.Errorf("BigBitVector.Truncate: error: %v", err)
+		}
+		n, _ = Count(ba)
+		if n != 511 {
+			t.Errorf("Count after Truncate: expected 511, got %d", n)
+		}
+		ba.Close()
+	}
+}
+
+func TestBitVector_Adaptive(t *testing.T) {
+	RunBitVectorBasicTests(t,
+		PageSize(32),
+		Adaptive())
+
+	// Mix sparse, dense, and run-heavy chunks, and keep so little in
+	// memory that most chunks get spilled.
+	const num = 8 * chunkBits
+	expect := func(index uint64) bool {
+		switch index / chunkBits {
+		case 0, 5:
+			return index%1000 == 0
+		case 1, 6:
+			return index%3 != 0
+		case 2, 7:
+			return (index/5000)%2 == 0
+		default:
+			return false
+		}
+	}
+
+	ba, err := New(NumValues(num), Adaptive(), OnDiskThreshold(16384))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+
+	iter := ba.Iterate(0, num)
+	for iter.Next() {
+		iter.SetBit(!expect(iter.Index()))
+		iter.SetBit(expect(iter.Index()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("Iterator.Close: error: %v", err)
+	}
+
+	var want uint64
+	err = ReverseForEach(ba, func(index uint64, bit bool) error {
+		if bit != expect(index) {
+			t.Fatalf("%d: expected %v, got %v", index, !bit, bit)
+		}
+		if bit {
+			want++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("ReverseForEach: error: %v", err)
+	}
+
+	n, err := Count(ba)
+	if err != nil || n != want {
+		t.Errorf("Count: expected %d, got %d (error: %v)", want, n, err)
+	}
+
+	if err := ba.Truncate(num - chunkBits/2 - 7); err != nil {
+		t.Errorf("BigBitVector.Truncate: error: %v", err)
+	}
+	bit, err := ba.BitAt(num - chunkBits/2 - 8)
+	if err != nil || bit != expect(num-chunkBits/2-8) {
+		t.Errorf("BigBitVector.BitAt after Truncate: got %v (error: %v)", bit, err)
+	}
+}
+
+func TestBitVector_Sparse(t *testing.T) {
+	RunBitVectorBasicTests(t,
+		PageSize(32),
+		Sparse())
+
+	const num = 1 << 40
+	ba, err := New(NumValues(num), ExpectedDensity(1e-9), OnDiskThreshold(4096))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+	if _, ok := ba.(*sparseArray); !ok {
+		t.Fatalf("New: expected *sparseArray, got %T", ba)
+	}
+
+	expect := make(map[uint64]bool)
+	for i := uint64(0); i < 5000; i++ {
+		index := (i * 0x9e3779b97f4a7c15) % num
+		expect[index] = true
+		if err := ba.SetBitAt(index, true); err != nil {
+			t.Fatalf("BigBitVector.SetBitAt %d: error: %v", index, err)
+		}
+	}
+	for i := uint64(0); i < 5000; i += 7 {
+		index := (i * 0x9e3779b97f4a7c15) % num
+		delete(expect, index)
+		if err := ba.SetBitAt(index, false); err != nil {
+			t.Fatalf("BigBitVector.SetBitAt %d: error: %v", index, err)
+		}
+	}
+
+	n, err := Count(ba)
+	if err != nil || n != uint64(len(expect)) {
+		t.Errorf("Count: expected %d, got %d (error: %v)", len(expect), n, err)
+	}
+	for index := range expect {
+		bit, err := ba.BitAt(index)
+		if err != nil || !bit {
+			t.Fatalf("BigBitVector.BitAt %d: expected true, got %v (error: %v)", index, bit, err)
+		}
+	}
+
+	// Walk a window around some set bit in both directions.
+	var probe uint64
+	for index := range expect {
+		if index > 100 && index < num-100 {
+			probe = index
+			break
+		}
+	}
+	for _, iter := range []Iterator{ba.Iterate(probe-100, probe+100), ba.ReverseIterate(probe-100, probe+100)} {
+		seen := 0
+		for iter.Next() {
+			if iter.Bit() != expect[iter.Index()] {
+				t.Errorf("%d: expected %v, got %v", iter.Index(), expect[iter.Index()], iter.Bit())
+			}
+			if iter.Index() == probe {
+				iter.SetBit(false)
+				iter.SetBit(true)
+			}
+			seen++
+		}
+		if err := iter.Close(); err != nil || seen != 200 {
+			t.Errorf("Iterator: visited %d bits (error: %v)", seen, err)
+		}
+	}
+	if bit, _ := ba.BitAt(probe); !bit {
+		t.Errorf("%d: expected true after SetBit", probe)
+	}
+}
+
+func TestBitVector_Sparse_SetDuringIteration(t *testing.T) {
+	ba, err := New(NumValues(1000), Sparse())
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+	ba.SetBitAt(500, true)
+
+	// Changes made behind the iterator's back, on either side of the set
+	// bit it has found next, must be visible when it gets there.
+	iter := ba.Iterate(0, ba.Len())
+	for iter.Next() {
+		index := iter.Index()
+		if index == 10 {
+			ba.SetBitAt(20, true)
+			ba.SetBitAt(500, false)
+		}
+		expect := index == 20
+		if iter.Bit() != expect {
+			t.Errorf("%d: expected %v, got %v", index, expect, iter.Bit())
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("Iterator.Close: error: %v", err)
+	}
+}
+
+func TestBitVector_Sparse_Spill(t *testing.T) {
+	const limit = 64 << 10
+	ba, err := New(NumValues(1<<40), Sparse(), OnDiskThreshold(limit))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+	bv := ba.(*sparseArray)
+
+	// Sequential inserts always land in the last leaf, so only the insert
+	// and split paths get a chance to evict.
+	const num = 200000
+	for i := uint64(0); i < num; i++ {
+		if err := ba.SetBitAt(i*3, true); err != nil {
+			t.Fatalf("BigBitVector.SetBitAt %d: error: %v", i*3, err)
+		}
+	}
+	spilled := 0
+	for _, leaf := range bv.leaves {
+		if !leaf.resident {
+			spilled++
+		}
+	}
+	if spilled == 0 {
+		t.Errorf("expected some of %d leaves to be spilled", len(bv.leaves))
+	}
+	if bv.mem > limit {
+		t.Errorf("expected at most %d resident bytes, got %d", limit, bv.mem)
+	}
+	if n, err := Count(ba); err != nil || n != num {
+		t.Errorf("Count: expected %d, got %d (error: %v)", num, n, err)
+	}
+	for _, i := range []uint64{0, 1, 12345, num - 1} {
+		if bit, err := ba.BitAt(i * 3); err != nil || !bit {
+			t.Errorf("BigBitVector.BitAt %d: expected true, got %v (error: %v)", i*3, bit, err)
+		}
+	}
+}
+
+func TestBitVector_Hybrid(t *testing.T) {
+	RunBitVectorBasicTests(t,
+		PageSize(32),
+		Hybrid())
+
+	pressure := false
+	ba, err := New(
+		PageSize(4096),
+		NumValues(300000),
+		Hybrid(),
+		MemoryBudget(func() bool { return pressure }))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+
+	type onDisker interface{ OnDisk() bool }
+	if ba.(onDisker).OnDisk() {
+		t.Error("expected to start in memory")
+	}
+
+	iter := ba.Iterate(0, ba.Len())
+	for iter.Next() {
+		if iter.Index() == 100000 {
+			pressure = true
+		}
+		iter.SetBit(iter.Index()%5 == 0)
+	}
+	if err := iter.Close(); err != nil {
+		t.Errorf("Iterator.Close: error: %v", err)
+	}
+	if !ba.(onDisker).OnDisk() {
+		t.Error("expected to spill to disk under memory pressure")
+	}
+
+	err = ReverseForEach(ba, func(index uint64, bit bool) error {
+		if bit != (index%5 == 0) {
+			t.Fatalf("%d: expected %v, got %v", index, !bit, bit)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("ReverseForEach: error: %v", err)
+	}
+
+	pressure = false
+	if err := ba.Truncate(1000); err != nil {
+		t.Errorf("BigBitVector.Truncate: error: %v", err)
+	}
+	if ba.(onDisker).OnDisk() {
+		t.Error("expected to return to memory after Truncate")
+	}
+	if n, _ := Count(ba); n != 200 {
+		t.Errorf("Count: expected 200, got %d", n)
+	}
+}
+
+func TestBitVector_OnDisk_PageCache(t *testing.T) {
+	RunBitVectorBasicTests(t,
+		PageSize(32),
+		OnDiskThreshold(0),
+		WithCache(NewPageCache(256)))
+
+	cache := NewPageCache(4 * 32)
+	var vecs []BigBitVector
+	for k := 0; k < 3; k++ {
+		ba, err := New(PageSize(32), NumValues(2048), OnDiskThreshold(0), WithCache(cache))
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+		defer ba.Close()
+		vecs = append(vecs, ba)
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		for k, ba := range vecs {
+			iter := ba.Iterate(0, ba.Len())
+			for iter.Next() {
+				if pass == 0 {
+					iter.SetBit(iter.Index()%uint64(k+2) == 0)
+				} else if iter.Bit() != (iter.Index()%uint64(k+2) == 0) {
+					t.Fatalf("vector %d, bit %d: expected %v", k, iter.Index(), !iter.Bit())
+				}
+			}
+			if err := iter.Close(); err != nil {
+				t.Errorf("Iterator.Close: error: %v", err)
+			}
+		}
+	}
+
+	stats := cache.Stats()
+	if stats.Bytes > 4*32 || stats.Pages != 4 {
+		t.Errorf("expected cache to be full at 4 pages, got %+v", stats)
+	}
+	if stats.Evictions == 0 || stats.Misses == 0 {
+		t.Errorf("expected evictions and misses, got %+v", stats)
+	}
+
+	// Re-reading the most recently used pages should not miss.
+	before := cache.Stats()
+	ba := vecs[len(vecs)-1]
+	if _, err := ba.BitAt(ba.Len() - 1); err != nil {
+		t.Errorf("BitAt: error: %v", err)
+	}
+	iter := ba.ReverseIterate(ba.Len()-64, ba.Len())
+	for iter.Next() {
+	}
+	iter.Close()
+	after := cache.Stats()
+	if after.Misses != before.Misses || after.Hits <= before.Hits {
+		t.Errorf("expected only hits, before %+v after %+v", before, after)
+	}
+
+	// Pinning more pages than the budget allows fails cleanly.
+	small := NewPageCache(32)
+	bb, err := New(PageSize(32), NumValues(2048), OnDiskThreshold(0), WithCache(small))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer bb.Close()
+	it1 := bb.Iterate(0, 8)
+	it2 := bb.Iterate(1024, 1032)
+	if !it1.Next() {
+		t.Errorf("Iterator.Next: unexpected error: %v", it1.Err())
+	}
+	if it2.Next() || it2.Err() != ErrCacheExhausted {
+		t.Errorf("expected ErrCacheExhausted, got %v", it2.Err())
+	}
+	it1.Close()
+	it2.Close()
+}
+
+type failingFile struct {
+	*os.File
+	failAt int64
+}
+
+func (f failingFile) WriteAt(p []byte, off int64) (int, error) {
+	if off >= f.failAt {
+		return 0, errors.New("injected write failure")
+	}
+	return f.File.WriteAt(p, off)
+}
+
+type flakyFile struct {
+	*os.File
+	fail bool
+}
+
+func (f *flakyFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.fail {
+		return 0, errors.New("injected write failure")
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func TestBitVector_OnDisk_CursorRetry(t *testing.T) {
+	f, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := f.Truncate(128); err != nil {
+		t.Fatalf("Truncate: error: %v", err)
+	}
+
+	ff := &flakyFile{File: f}
+	ba, err := New(PageSize(32), NumValues(1024), WithFile(ff))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+
+	// A write that fails when the cursor closes must be kept for the next
+	// Flush to retry, not silently dropped.
+	ff.fail = true
+	if err := Scatter(ba, []uint64{5}, true); err == nil {
+		t.Error("Scatter: expected error")
+	}
+	if err := ba.Flush(); err == nil {
+		t.Error("BigBitVector.Flush: expected error")
+	}
+	ff.fail = false
+	if err := ba.Flush(); err != nil {
+		t.Errorf("BigBitVector.Flush: error: %v", err)
+	}
+	var tmp [1]byte
+	if _, err := f.ReadAt(tmp[:], 0); err != nil || tmp[0] != 0x20 {
+		t.Errorf("ReadAt: expected 0x20, got %#02x (error: %v)", tmp[0], err)
+	}
+
+	// Pages kept after a failed write-back are not live iterators, so
+	// neither Truncate nor Close may panic over them.
+	ff.fail = true
+	if err := Scatter(ba, []uint64{7}, true); err == nil {
+		t.Error("Scatter: expected error")
+	}
+	if err := ba.Truncate(512); err == nil {
+		t.Error("BigBitVector.Truncate: expected error")
+	}
+	ff.fail = false
+	if err := ba.Truncate(512); err != nil {
+		t.Errorf("BigBitVector.Truncate: error: %v", err)
+	}
+	if _, err := f.ReadAt(tmp[:], 0); err != nil || tmp[0] != 0xa0 {
+		t.Errorf("ReadAt: expected 0xa0, got %#02x (error: %v)", tmp[0], err)
+	}
+
+	ff.fail = true
+	if err := Scatter(ba, []uint64{6}, true); err == nil {
+		t.Error("Scatter: expected error")
+	}
+	if err := ba.Close(); err == nil {
+		t.Error("BigBitVector.Close: expected error")
+	}
+}
+
+func TestBitVector_OnDisk_SharedCacheReadAhead(t *testing.T) {
+	// Vectors on different goroutines evict each other's idle pages while
+	// their iterators write behind and SetBitAt waits for those writes.
+	pc := NewPageCache(64 * 24)
+	var wg sync.WaitGroup
+	for v := 0; v < 6; v++ {
+		ba, err := New(PageSize(64), NumValues(64*8*32), OnDiskThreshold(0), ReadAhead(2), WithCache(pc))
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+		wg.Add(1)
+		go func(ba BigBitVector) {
+			defer wg.Done()
+			defer ba.Close()
+			for pass := uint64(0); pass < 4; pass++ {
+				iter := ba.Iterate(0, ba.Len())
+				for iter.Next() {
+					iter.SetBit(iter.Index()%(pass+2) == 0)
+				}
+				if err := iter.Close(); err != nil {
+					t.Errorf("Iterator.Close: error: %v", err)
+				}
+				for index := uint64(0); index < ba.Len(); index += 61 {
+					if err := ba.SetBitAt(index, true); err != nil {
+						t.Errorf("BigBitVector.SetBitAt %d: error: %v", index, err)
+					}
+				}
+			}
+			for index := uint64(0); index < ba.Len(); index++ {
+				expect := index%5 == 0 || index%61 == 0
+				if bit, err := ba.BitAt(index); err != nil || bit != expect {
+					t.Errorf("%d: expected %v, got %v (error: %v)", index, expect, bit, err)
+					return
+				}
+			}
+		}(ba)
+	}
+	wg.Wait()
+}
+
+func TestBitVector_OnDisk_SetBitRetry(t *testing.T) {
+	f, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err := f.Truncate(128); err != nil {
+		t.Fatalf("Truncate: error: %v", err)
+	}
+
+	ff := &flakyFile{File: f}
+	ba, err := New(PageSize(32), NumValues(1024), WithFile(ff), WithChecksums(nil))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+
+	// Neither SetBitAt nor an iterator may drop a write that fails.
+	ff.fail = true
+	if err := ba.SetBitAt(5, true); err == nil {
+		t.Error("BigBitVector.SetBitAt: expected error")
+	}
+	iter := ba.Iterate(300, 301)
+	for iter.Next() {
+		iter.SetBit(true)
+	}
+	if err := iter.Close(); err == nil {
+		t.Error("Iterator.Close: expected error")
+	}
+	ff.fail = false
+	if err := ba.Flush(); err != nil {
+		t.Errorf("BigBitVector.Flush: error: %v", err)
+	}
+	var tmp [1]byte
+	for _, x := range []struct{ off, b byte }{{0, 0x20}, {37, 0x10}} {
+		if _, err := f.ReadAt(tmp[:], int64(x.off)); err != nil || tmp[0] != x.b {
+			t.Errorf("ReadAt %d: expected %#02x, got %#02x (error: %v)", x.off, x.b, tmp[0], err)
+		}
+	}
+	if err := Verify(ba); err != nil {
+		t.Errorf("Verify: error: %v", err)
+	}
+}
+
+func TestBitVector_OnDisk_ReadAhead(t *testing.T) {
+	RunBitVectorBasicTests(t,
+		PageSize(32),
+		OnDiskThreshold(0),
+		ReadAhead(4))
+
+	for _, opt := range []Option{WithPool(nil), WithChecksums(nil), WithCache(NewPageCache(1024))} {
+		ba, err := New(PageSize(32), NumValues(4096), OnDiskThreshold(0), ReadAhead(4), opt)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+
+		iter := ba.ReverseIterate(0, ba.Len())
+		for iter.Next() {
+			iter.SetBit(iter.Index()%3 == 0)
+		}
+		if err := iter.Close(); err != nil {
+			t.Errorf("Iterator.Close: error: %v", err)
+		}
+
+		// Writes that land on pages which have already been read ahead
+		// must be visible to the reading iterator.
+		iter = ba.Iterate(0, ba.Len())
+		if !iter.Next() {
+			t.Fatalf("Iterator.Next: error: %v", iter.Err())
+		}
+		writer := ba.Iterate(768, 1024)
+		for writer.Next() {
+			writer.SetBit(true)
+		}
+		if err := writer.Close(); err != nil {
+			t.Errorf("Iterator.Close: error: %v", err)
+		}
+		if err := ba.SetBitAt(1501, true); err != nil {
+			t.Errorf("BigBitVector.SetBitAt: error: %v", err)
+		}
+		for {
+			index := iter.Index()
+			expected := index%3 == 0 || (index >= 768 && index < 1024) || index == 1501
+			if iter.Bit() != expected {
+				t.Fatalf("%d: expected %v, got %v", index, expected, iter.Bit())
+			}
+			if !iter.Next() {
+				break
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.Errorf("Iterator.Close: error: %v", err)
+		}
+		if n, _ := Count(ba); n != 1366+256-86+1 {
+			t.Errorf("Count: expected %d, got %d", 1366+256-86+1, n)
+		}
+		ba.Close()
+	}
+
+	f, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if err := f.Truncate(512); err != nil {
+		t.Fatalf("Truncate: error: %v", err)
+	}
+	ba, err := New(PageSize(32), NumValues(4096), WithFile(failingFile{f, 256}), ReadAhead(2))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+	iter := ba.Iterate(0, ba.Len())
+	for iter.Next() {
+		iter.SetBit(true)
+	}
+	if iter.Err() == nil {
+		t.Error("expected a write error from Iterator.Err")
+	}
+	if err := iter.Close(); err == nil {
+		t.Error("expected a write error from Iterator.Close")
+	}
+}
+
+func TestBitVector_Words(t *testing.T) {
+	for _, opt := range []Option{OnDiskThreshold(1 << 20), OnDiskThreshold(0), Adaptive(), Sparse(), Atomic()} {
+		ba, err := New(PageSize(32), NumValues(1000), opt)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+
+		iter := IterateWords(ba, 10, 990)
+		var n int
+		for iter.Next() {
+			if iter.Index()%64 != 0 {
+				t.Errorf("Index: expected a multiple of 64, got %d", iter.Index())
+			}
+			if iter.Word() != 0 {
+				t.Errorf("%d: expected an empty word, got %016x", iter.Index(), iter.Word())
+			}
+			iter.SetWord(0x5555555555555555)
+			n++
+		}
+		if err := iter.Close(); err != nil {
+			t.Errorf("WordIterator.Close: error: %v", err)
+		}
+		if n != 16 {
+			t.Errorf("expected 16 words, got %d", n)
+		}
+
+		err = ForEach(ba, func(index uint64, bit bool) error {
+			expected := index >= 10 && index < 990 && index%2 == 0
+			if bit != expected {
+				t.Fatalf("%d: expected %v, got %v", index, expected, bit)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("ForEach: error: %v", err)
+		}
+
+		iter = IterateWords(ba, 0, ba.Len())
+		for iter.Next() {
+			switch iter.Index() {
+			case 0:
+				if iter.Mask() != ^uint64(0) || iter.Word() != 0x5555555555555400 {
+					t.Errorf("first word: got %016x mask %016x", iter.Word(), iter.Mask())
+				}
+			case 960:
+				if iter.Mask() != (uint64(1)<<40)-1 || iter.Word() != 0x0000000015555555 {
+					t.Errorf("last word: got %016x mask %016x", iter.Word(), iter.Mask())
+				}
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.Errorf("WordIterator.Close: error: %v", err)
+		}
+
+		ba.SetBitAt(996, true)
+		ba.SetBitAt(998, true)
+		if err := ba.Truncate(997); err != nil {
+			t.Errorf("BigBitVector.Truncate: error: %v", err)
+		}
+		var packed []byte
+		err = ForEachPage(ba, func(offset uint64, page []byte) error {
+			if offset != uint64(len(packed)) {
+				t.Errorf("ForEachPage: expected offset %d, got %d", len(packed), offset)
+			}
+			packed = append(packed, page...)
+			return nil
+		})
+		if err != nil {
+			t.Errorf("ForEachPage: error: %v", err)
+		}
+		if len(packed) != 125 {
+			t.Fatalf("ForEachPage: expected 125 bytes, got %d", len(packed))
+		}
+		if packed[1] != 0x54 || packed[60] != 0x55 || packed[123] != 0x15 || packed[124] != 0x10 {
+			t.Errorf("ForEachPage: unexpected bytes % x", packed)
+		}
+		ba.Close()
+	}
+}
+
+type countingFile struct {
+	*os.File
+	writes *int
+}
+
+func (f countingFile) WriteAt(p []byte, off int64) (int, error) {
+	*f.writes++
+	return f.File.WriteAt(p, off)
+}
+
+func TestBitVector_ReadWriteBits(t *testing.T) {
+	src := []byte{0xde, 0xad, 0xbe, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab}
+	for _, opt := range []Option{OnDiskThreshold(1 << 20), OnDiskThreshold(0), Adaptive(), Hybrid(), Atomic()} {
+		ba, err := New(PageSize(32), NumValues(1000), opt)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+
+		for _, off := range []uint64{0, 3, 250, 251, 509} {
+			nbits := uint64(len(src))*8 - 5
+			if err := WriteBits(ba, src, off, nbits); err != nil {
+				t.Errorf("WriteBits %d: error: %v", off, err)
+			}
+			for k := uint64(0); k < nbits; k++ {
+				b, m := byteAndMask(k)
+				bit, _ := ba.BitAt(off + k)
+				if bit != ((src[b] & m) != 0) {
+					t.Fatalf("offset %d, bit %d: expected %v", off, k, !bit)
+				}
+			}
+			if bit, _ := ba.BitAt(off + nbits); bit {
+				t.Errorf("offset %d: bit past the range was modified", off)
+			}
+
+			dst := make([]byte, len(src))
+			for i := range dst {
+				dst[i] = 0xff
+			}
+			if err := ReadBits(ba, dst, off, nbits); err != nil {
+				t.Errorf("ReadBits %d: error: %v", off, err)
+			}
+			expected := append([]byte(nil), src...)
+			expected[len(expected)-1] &= 0x07
+			if string(dst) != string(expected) {
+				t.Errorf("ReadBits %d: expected % x, got % x", off, expected, dst)
+			}
+
+			if err := WriteBits(ba, make([]byte, len(src)), off, nbits); err != nil {
+				t.Errorf("WriteBits %d: error: %v", off, err)
+			}
+		}
+		if n, _ := Count(ba); n != 0 {
+			t.Errorf("Count: expected 0, got %d", n)
+		}
+		if err := ReadBits(ba, make([]byte, 2), 990, 16); err != io.EOF {
+			t.Errorf("ReadBits past end: expected io.EOF, got %v", err)
+		}
+		ba.Close()
+	}
+
+	f, err := ioutil.TempFile("", "tmp")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if err := f.Truncate(128); err != nil {
+		t.Fatalf("Truncate: error: %v", err)
+	}
+	writes := 0
+	ba, err := New(PageSize(32), NumValues(1024), WithFile(countingFile{f, &writes}))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+	pattern := make([]byte, 64)
+	for i := range pattern {
+		pattern[i] = 0xaa
+	}
+	if err := WriteBits(ba, pattern, 100, 512); err != nil {
+		t.Errorf("WriteBits: error: %v", err)
+	}
+	if err := WriteBits(ba, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 250, 60); err != nil {
+		t.Errorf("WriteBits: error: %v", err)
+	}
+	if writes != 5 {
+		t.Errorf("expected one WriteAt per page touched, got %d", writes)
+	}
+
+	// The bitvector can itself back another bitvector.
+	inner := AsFile(ba)
+	outer, err := New(PageSize(16), NumValues(1024), WithFile(inner))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	if bit, _ := outer.BitAt(300); !bit {
+		t.Error("outer 300: expected true, got false")
+	}
+	if err := outer.SetBitAt(7, true); err != nil {
+		t.Errorf("BigBitVector.SetBitAt: error: %v", err)
+	}
+	if err := outer.Close(); err != nil {
+		t.Errorf("BigBitVector.Close: error: %v", err)
+	}
+	if bit, _ := ba.BitAt(7); !bit {
+		t.Error("inner 7: expected true, got false")
+	}
+	var buf [200]byte
+	if n, err := inner.ReadAt(buf[:], 0); n != 128 || err != io.EOF {
+		t.Errorf("ReadAt: expected 128 bytes and io.EOF, got %d and %v", n, err)
+	}
+}
+
+func TestBitVector_Cursor(t *testing.T) {
+	for _, opt := range []Option{OnDiskThreshold(1 << 20), OnDiskThreshold(0), Adaptive(), Sparse(), Atomic()} {
+		ba, err := New(PageSize(32), NumValues(1000), opt)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+
+		c := NewCursor(ba)
+		if !c.Prev() || c.Index() != 999 {
+			t.Fatal("Cursor.Prev: expected to start at the last bit")
+		}
+		for c.Prev() {
+			c.SetBit(c.Index()%7 == 0)
+		}
+		if c.Index() != 0 {
+			t.Errorf("Cursor.Index: expected 0, got %d", c.Index())
+		}
+		if !c.Seek(500) || !c.Next() || !c.Prev() || c.Index() != 500 {
+			t.Error("Cursor: unexpected position after Seek/Next/Prev")
+		}
+		if c.Seek(1000) || c.Index() != 500 {
+			t.Error("Cursor.Seek: expected out of range Seek to fail in place")
+		}
+		c.SetBit(true)
+		if err := c.Close(); err != nil {
+			t.Errorf("Cursor.Close: error: %v", err)
+		}
+
+		const width = 50
+		lead, trail := NewCursor(ba), NewCursor(ba)
+		count := 0
+		for lead.Next() {
+			if lead.Bit() {
+				count++
+			}
+			if lead.Index() >= width {
+				trail.Next()
+				if trail.Bit() {
+					count--
+				}
+			}
+			expected := 0
+			for k := uint64(0); k < width && k <= lead.Index(); k++ {
+				index := lead.Index() - k
+				if index%7 == 0 || index == 500 {
+					expected++
+				}
+			}
+			if count != expected {
+				t.Fatalf("%d: expected window count %d, got %d", lead.Index(), expected, count)
+			}
+		}
+		if err := lead.Close(); err != nil {
+			t.Errorf("Cursor.Close: error: %v", err)
+		}
+		if err := trail.Close(); err != nil {
+			t.Errorf("Cursor.Close: error: %v", err)
+		}
+		ba.Close()
+	}
+}
+
+func TestBitVector_IteratorReset(t *testing.T) {
+	for _, opt := range []Option{OnDiskThreshold(1 << 20), OnDiskThreshold(0), Adaptive(), Sparse(), Hybrid(), Atomic()} {
+		ba, err := New(PageSize(32), NumValues(1000), opt)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+
+		iter := ba.Iterate(0, 0)
+		if err := iter.Close(); err != nil {
+			t.Errorf("Iterator.Close: error: %v", err)
+		}
+		if err := iter.Close(); err != ErrClosedIterator {
+			t.Errorf("Iterator.Close: expected ErrClosedIterator, got %v", err)
+		}
+
+		for pass := uint64(0); pass < 3; pass++ {
+			if err := iter.Reset(100, 900, pass%2 == 1); err != nil {
+				t.Errorf("Iterator.Reset: error: %v", err)
+			}
+			expected := uint64(899)
+			if pass%2 == 0 {
+				expected = 100
+			}
+			for iter.Next() {
+				if iter.Index() != expected {
+					t.Fatalf("pass %d: expected index %d, got %d", pass, expected, iter.Index())
+				}
+				if pass%2 == 0 {
+					expected++
+				} else {
+					expected--
+				}
+				if pass > 0 && iter.Bit() != (iter.Index()%(pass+2) == 0) {
+					t.Fatalf("pass %d, bit %d: expected %v", pass, iter.Index(), !iter.Bit())
+				}
+				iter.SetBit(iter.Index()%(pass+3) == 0)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.Errorf("Iterator.Close: error: %v", err)
+		}
+		if n, _ := Count(ba); n != 160 {
+			t.Errorf("Count: expected 160, got %d", n)
+		}
+		ba.Close()
+	}
+}
+
+func TestBitVector_IteratorResetAllocs(t *testing.T) {
+	for _, opt := range []Option{OnDiskThreshold(1 << 20), OnDiskThreshold(0)} {
+		ba, err := New(PageSize(32), NumValues(4096), opt)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+		iter := ba.Iterate(0, 0)
+		allocs := testing.AllocsPerRun(10, func() {
+			iter.Reset(0, ba.Len(), false)
+			for iter.Next() {
+				iter.SetBit(!iter.Bit())
+			}
+			iter.Close()
+		})
+		if allocs != 0 {
+			t.Errorf("expected no allocations per scan, got %v", allocs)
+		}
+		ba.Close()
+	}
+}
+
+func benchmarkIteratorReset(b *testing.B, opts ...Option) {
+	ba, err := New(append(opts, NumValues(1<<20))...)
+	if err != nil {
+		b.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+
+	iter := ba.Iterate(0, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		iter.Reset(0, ba.Len(), n%2 == 1)
+		for iter.Next() {
+			iter.SetBit(!iter.Bit())
+		}
+	}
+	if err := iter.Close(); err != nil {
+		b.Errorf("Iterator.Close: error: %v", err)
+	}
+}
+
+func BenchmarkIteratorReset_InMemory(b *testing.B) {
+	benchmarkIteratorReset(b)
+}
+
+func BenchmarkIteratorReset_OnDisk(b *testing.B) {
+	benchmarkIteratorReset(b, PageSize(4096), OnDiskThreshold(0))
+}
+
+func TestBitVector_Parallel(t *testing.T) {
+	for _, opts := range [][]Option{
+		{OnDiskThreshold(1 << 20)},
+		{OnDiskThreshold(0)},
+		{OnDiskThreshold(0), WithCache(NewPageCache(1024)), ReadAhead(2)},
+		{Adaptive()},
+		{Hybrid()},
+		{Atomic()},
+	} {
+		ba, err := New(append(opts, PageSize(32), NumValues(100000))...)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+
+		ranges := Partition(ba, 7)
+		if len(ranges) == 0 || len(ranges) > 7 || ranges[0].Start != 0 || ranges[len(ranges)-1].End != ba.Len() {
+			t.Fatalf("Partition: unexpected ranges %v", ranges)
+		}
+		for i, r := range ranges {
+			if i > 0 && r.Start != ranges[i-1].End {
+				t.Errorf("Partition: range %d does not follow range %d", i, i-1)
+			}
+			if r.Start%partitionAlign(ba) != 0 {
+				t.Errorf("Partition: range %d is not page-aligned", i)
+			}
+		}
+
+		err = ParallelRanges(context.Background(), ba, 4, func(ctx context.Context, iter Iterator) error {
+			for iter.Next() {
+				iter.SetBit(iter.Index()%3 == 0)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("ParallelRanges: error: %v", err)
+		}
+
+		var mu sync.Mutex
+		var total uint64
+		err = ParallelForEach(context.Background(), ba, 4, func(index uint64, bit bool) error {
+			if bit != (index%3 == 0) {
+				return fmt.Errorf("%d: expected %v, got %v", index, !bit, bit)
+			}
+			if bit {
+				mu.Lock()
+				total++
+				mu.Unlock()
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("ParallelForEach: error: %v", err)
+		}
+		if total != 33334 {
+			t.Errorf("ParallelForEach: expected 33334 set bits, got %d", total)
+		}
+
+		failure := errors.New("failure")
+		err = ParallelForEach(context.Background(), ba, 4, func(index uint64, bit bool) error {
+			if index%10000 == 5 {
+				return failure
+			}
+			return nil
+		})
+		if err != failure {
+			if errs, ok := err.(MultiError); !ok || errs[0] != failure {
+				t.Errorf("ParallelForEach: expected failure, got %v", err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err = ParallelForEach(ctx, ba, 4, func(index uint64, bit bool) error { return nil })
+		if err != context.Canceled {
+			t.Errorf("ParallelForEach: expected context.Canceled, got %v", err)
+		}
+		ba.Close()
+	}
+}
+
+func TestBitVector_Context(t *testing.T) {
+	for _, opts := range [][]Option{
+		{OnDiskThreshold(1 << 20)},
+		{OnDiskThreshold(0)},
+		{OnDiskThreshold(0), ReadAhead(2)},
+		{Adaptive()},
+		{Hybrid(), OnDiskThreshold(0), ReadAhead(2)},
+	} {
+		ba, err := New(append(opts, PageSize(32), NumValues(10000))...)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var n uint64
+		err = ForEachContext(ctx, ba, func(index uint64, bit bool) error {
+			n++
+			if index == 999 {
+				cancel()
+			}
+			return nil
+		})
+		if err != context.Canceled {
+			t.Errorf("ForEachContext: expected context.Canceled, got %v", err)
+		}
+		if n != 1000 {
+			t.Errorf("ForEachContext: expected 1000 calls, got %d", n)
+		}
+
+		err = ReverseForEachContext(context.Background(), ba, func(index uint64, bit bool) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Errorf("ReverseForEachContext: error: %v", err)
+		}
+		if n != 11000 {
+			t.Errorf("ReverseForEachContext: expected 10000 calls, got %d", n-1000)
+		}
+
+		iter := BindContext(ctx, ba.Iterate(0, ba.Len()))
+		if iter.Next() {
+			t.Errorf("BindContext: Next succeeded after cancel")
+		}
+		if iter.Err() != context.Canceled {
+			t.Errorf("BindContext: expected context.Canceled, got %v", iter.Err())
+		}
+		iter.Close()
+
+		// The context must reach the on-disk iterator inside a hybrid one,
+		// so that it stops reading ahead.
+		iter = BindContext(ctx, ba.Iterate(0, ba.Len()))
+		if h, ok := iter.(*contextIterator).Iterator.(*hybridIterator); ok {
+			if inner := h.inner.(*onDiskIterator); inner.ctx != ctx {
+				t.Errorf("BindContext: expected the context to reach %T", inner)
+			}
+		}
+		iter.Close()
+
+		if x, ok := ba.(*onDiskArray); ok {
+			if _, err := x.acquirePageContext(ctx, 0); err != context.Canceled {
+				t.Errorf("acquirePageContext: expected context.Canceled, got %v", err)
+			}
+		}
+		ba.Close()
+	}
+}
+
+func TestBitVector_Atomic(t *testing.T) {
+	RunBitVectorBasicTests(t,
+		PageSize(32),
+		Atomic())
+
+	ba, err := New(NumValues(1000), Atomic())
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer ba.Close()
+
+	vec, ok := ba.(AtomicBitVector)
+	if !ok {
+		t.Fatalf("New: expected an AtomicBitVector, got %T", ba)
+	}
+
+	var wg sync.WaitGroup
+	var won [8]uint64
+	for g := range won {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := uint64(0); i < vec.Len(); i++ {
+				if old, err := vec.TestAndSet(i); err != nil {
+					t.Errorf("TestAndSet %d: error: %v", i, err)
+				} else if !old {
+					won[g]++
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	var total uint64
+	for _, n := range won {
+		total += n
+	}
+	if total != 1000 {
+		t.Errorf("TestAndSet: expected 1000 first setters, got %d", total)
+	}
+	if n, _ := Count(vec); n != 1000 {
+		t.Errorf("Count: expected 1000, got %d", n)
+	}
+
+	if old, err := vec.TestAndClear(64); err != nil || !old {
+		t.Errorf("TestAndClear 64: expected true, got %v (error: %v)", old, err)
+	}
+	if old, _ := vec.TestAndClear(64); old {
+		t.Errorf("TestAndClear 64: expected false on second call")
+	}
+	if _, err := vec.TestAndSet(1000); err != io.EOF {
+		t.Errorf("TestAndSet 1000: expected io.EOF, got %v", err)
+	}
+
+	word, err := vec.LoadWord(1)
+	if err != nil || word != ^uint64(1) {
+		t.Errorf("LoadWord 1: expected %016x, got %016x (error: %v)", ^uint64(1), word, err)
+	}
+	if ok, _ := vec.CompareAndSwapWord(1, 0, 0xff); ok {
+		t.Errorf("CompareAndSwapWord: succeeded with a stale word")
+	}
+	if ok, _ := vec.CompareAndSwapWord(1, word, 0xff); !ok {
+		t.Errorf("CompareAndSwapWord: failed with a current word")
+	}
+	if bit, _ := vec.BitAt(72); bit {
+		t.Errorf("72: expected false after CompareAndSwapWord")
+	}
+
+	// The last word holds only 1000-960 = 40 bits.
+	if word, _ := vec.LoadWord(15); word != uint64(1)<<40-1 {
+		t.Errorf("LoadWord 15: expected %016x, got %016x", uint64(1)<<40-1, word)
+	}
+	if ok, _ := vec.CompareAndSwapWord(15, ^uint64(0), 0); !ok {
+		t.Errorf("CompareAndSwapWord 15: expected bits past the end to be ignored")
+	}
+	if err := vec.Truncate(900); err != nil {
+		t.Errorf("Truncate: error: %v", err)
+	}
+	if n, _ := Count(vec); n != 900-64+8 {
+		t.Errorf("Count: expected %d, got %d", 900-64+8, n)
+	}
+}
+
+// lockHelperEnv names the file which TestLockHelper locks when it is run as a
+// child process of TestBitVector_Locking.
+const lockHelperEnv = "BIGBITVECTOR_LOCK_HELPER"
+
+func TestLockHelper(t *testing.T) {
+	path := os.Getenv(lockHelperEnv)
+	if path == "" {
+		t.Skip("only runs as a child process")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	opt := Locking()
+	if os.Getenv(lockHelperEnv+"_PAGES") != "" {
+		opt = PageLocking()
+	}
+	ba, err := New(WithFile(f), opt, OnDiskThreshold(0), PageSize(32), NumValues(1024))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	iter := ba.Iterate(0, 8)
+	if !iter.Next() {
+		fmt.Println(iter.Err())
+		os.Exit(1)
+	}
+	iter.SetBit(true)
+	fmt.Println("locked")
+	ioutil.ReadAll(os.Stdin)
+	iter.Close()
+	ba.Close()
+	os.Exit(0)
+}
+
+func TestBitVector_Locking(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "lock")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	path := tmp.Name()
+	defer os.Remove(path)
+	tmp.Truncate(128)
+	tmp.Close()
+
+	open := func(opts ...Option) (BigBitVector, error) {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatalf("OpenFile: error: %v", err)
+		}
+		return New(append(opts, WithFile(f), OnDiskThreshold(0), PageSize(32), NumValues(1024))...)
+	}
+
+	helper := func(pages bool) (*exec.Cmd, io.WriteCloser) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelper$")
+		cmd.Env = append(os.Environ(), lockHelperEnv+"="+path)
+		if pages {
+			cmd.Env = append(cmd.Env, lockHelperEnv+"_PAGES=1")
+		}
+		stdin, _ := cmd.StdinPipe()
+		stdout, _ := cmd.StdoutPipe()
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Start: error: %v", err)
+		}
+		line, _ := bufio.NewReader(stdout).ReadString('\n')
+		if line != "locked\n" {
+			t.Fatalf("helper: expected \"locked\", got %q", line)
+		}
+		return cmd, stdin
+	}
+
+	expectLockError := func(what string, err error, pid int, start int64) {
+		t.Helper()
+		lerr, ok := err.(*LockError)
+		if !ok {
+			t.Errorf("%s: expected a *LockError, got %v", what, err)
+			return
+		}
+		if lerr.PID != pid || lerr.Start != start {
+			t.Errorf("%s: expected a lock at %d held by process %d, got %v", what, start, pid, lerr)
+		}
+	}
+
+	cmd, stdin := helper(false)
+	_, err = open(Locking())
+	expectLockError("Locking", err, cmd.Process.Pid, 0)
+	_, err = open(PageLocking())
+	expectLockError("PageLocking", err, cmd.Process.Pid, 0)
+	stdin.Close()
+	cmd.Wait()
+
+	cmd, stdin = helper(true)
+	_, err = open(Locking())
+	expectLockError("Locking", err, cmd.Process.Pid, 0)
+	ba, err := open(PageLocking())
+	if err != nil {
+		t.Fatalf("PageLocking: error: %v", err)
+	}
+	if err := ba.SetBitAt(900, true); err != nil {
+		t.Errorf("SetBitAt 900: error: %v", err)
+	}
+	_, err = ba.BitAt(3)
+	expectLockError("BitAt 3", err, cmd.Process.Pid, 0)
+	iter := ba.Iterate(200, 300)
+	for iter.Next() {
+	}
+	expectLockError("Iterate", iter.Close(), cmd.Process.Pid, 0)
+	ba.Close()
+	stdin.Close()
+	cmd.Wait()
+
+	ba, err = open(Locking())
+	if err != nil {
+		t.Fatalf("Locking: error: %v", err)
+	}
+	for _, index := range []uint64{0, 900} {
+		if bit, err := ba.BitAt(index); err != nil || !bit {
+			t.Errorf("%d: expected true, got %v (error: %v)", index, bit, err)
+		}
+	}
+	ba.Close()
+
+	// Pages which are no longer in use must not stay locked in a PageCache.
+	ba, err = open(PageLocking(), WithCache(NewPageCache(1024)))
+	if err != nil {
+		t.Fatalf("PageLocking: error: %v", err)
+	}
+	if err := ba.SetBitAt(3, true); err != nil {
+		t.Errorf("SetBitAt 3: error: %v", err)
+	}
+	cmd, stdin = helper(true)
+	stdin.Close()
+	cmd.Wait()
+	if bit, err := ba.BitAt(0); err != nil || !bit {
+		t.Errorf("0: expected true, got %v (error: %v)", bit, err)
+	}
+	ba.Close()
+
+	for _, opt := range []Option{Encrypted([]byte("0123456789abcdef")), Compressed(CodecRLE)} {
+		if _, err := open(PageLocking(), opt); err == nil {
+			t.Error("PageLocking: expected error with Encrypted or Compressed")
+		}
+	}
+}
+
+type readCountingFile struct {
+	*os.File
+	reads *int
+}
+
+func (f readCountingFile) ReadAt(p []byte, off int64) (int, error) {
+	*f.reads++
+	return f.File.ReadAt(p, off)
+}
+
+func TestBitVector_Expr(t *testing.T) {
+	f, err := ioutil.TempFile("", "expr")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Truncate(125)
+	var reads int
+
+	var vecs [4]BigBitVector
+	for i, opt := range []Option{OnDiskThreshold(1 << 20), WithFile(readCountingFile{f, &reads}), Adaptive(), Sparse()} {
+		vecs[i], err = New(PageSize(32), NumValues(1000), opt)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+		defer vecs[i].Close()
+	}
+	moduli := []uint64{2, 3, 5, 7}
+	for i, ba := range vecs {
+		for index := uint64(0); index < ba.Len(); index += moduli[i] {
+			ba.SetBitAt(index, true)
+		}
+	}
+	expect := func(index uint64) bool {
+		a, b, c, d := index%2 == 0, index%3 == 0, index%5 == 0, index%7 == 0
+		return (a && b) || (c && !d)
+	}
+	a, b, c, d := Leaf(vecs[0]), Leaf(vecs[1]), Leaf(vecs[2]), Leaf(vecs[3])
+	e := Or(And(a, b), And(c, Not(d)))
+
+	var want uint64
+	for index := uint64(0); index < 1000; index++ {
+		if expect(index) {
+			want++
+		}
+	}
+	reads = 0
+	n, err := CountExpr(e)
+	if err != nil || n != want {
+		t.Errorf("CountExpr: expected %d, got %d (error: %v)", want, n, err)
+	}
+	if reads != 4 {
+		t.Errorf("CountExpr: expected 4 page reads, got %d", reads)
+	}
+
+	var last uint64
+	n = 0
+	err = ForEachExpr(e, func(index uint64) error {
+		if !expect(index) || (n != 0 && index <= last) {
+			t.Errorf("ForEachExpr: unexpected index %d", index)
+		}
+		last = index
+		n++
+		return nil
+	})
+	if err != nil || n != want {
+		t.Errorf("ForEachExpr: expected %d calls, got %d (error: %v)", want, n, err)
+	}
+
+	dst, err := New(PageSize(32), NumValues(1000), OnDiskThreshold(0))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer dst.Close()
+	dst.SetBitAt(1, true)
+	if err := Materialize(dst, e); err != nil {
+		t.Errorf("Materialize: error: %v", err)
+	}
+	for index := uint64(0); index < 1000; index++ {
+		if bit, _ := dst.BitAt(index); bit != expect(index) {
+			t.Errorf("%d: expected %v, got %v", index, expect(index), bit)
+		}
+	}
+
+	// Xor the result with itself in place, clearing it.
+	if err := Materialize(dst, Xor(Leaf(dst), Leaf(dst))); err != nil {
+		t.Errorf("Materialize: error: %v", err)
+	}
+	if n, _ := Count(dst); n != 0 {
+		t.Errorf("Materialize: expected an empty result, got %d bits", n)
+	}
+	if err := Materialize(dst, Not(Leaf(dst))); err != nil {
+		t.Errorf("Materialize: error: %v", err)
+	}
+	if n, _ := Count(dst); n != 1000 {
+		t.Errorf("Materialize: expected 1000 bits, got %d", n)
+	}
+}
+
+func TestBitVector_Threshold(t *testing.T) {
+	opts := []Option{OnDiskThreshold(1 << 20), OnDiskThreshold(0), Adaptive(), Sparse(), Atomic()}
+	srcs := make([]BigBitVector, 10)
+	want := make([]uint, 1000)
+	for s := range srcs {
+		ba, err := New(PageSize(32), NumValues(1000), opts[s%len(opts)])
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+		defer ba.Close()
+		for index := uint64(s); index < ba.Len(); index += uint64(s) + 1 {
+			ba.SetBitAt(index, true)
+			want[index]++
+		}
+		srcs[s] = ba
+	}
+
+	dst, err := New(PageSize(32), NumValues(1000), OnDiskThreshold(0))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer dst.Close()
+	for _, k := range []uint{0, 1, 3, 10, 11} {
+		if err := Threshold(dst, k, srcs...); err != nil {
+			t.Errorf("Threshold %d: error: %v", k, err)
+		}
+		for index, n := range want {
+			if bit, _ := dst.BitAt(uint64(index)); bit != (n >= k) {
+				t.Errorf("Threshold %d: %d: expected %v, got %v", k, index, n >= k, bit)
+			}
+		}
+	}
+
+	counts, err := New(NumValues(4000))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	width, err := Counts(AsFile(counts), srcs...)
+	if err != nil || width != 4 {
+		t.Fatalf("Counts: expected width 4, got %d (error: %v)", width, err)
+	}
+	for index, n := range want {
+		var got uint
+		for j := uint(0); j < width; j++ {
+			if bit, _ := counts.BitAt(uint64(index)*uint64(width) + uint64(j)); bit {
+				got |= 1 << j
+			}
+		}
+		if got != n {
+			t.Errorf("Counts: %d: expected %d, got %d", index, n, got)
+		}
+	}
+}
+
+func TestBitVector_Compare(t *testing.T) {
+	for _, opts := range [][2]Option{
+		{OnDiskThreshold(1 << 20), OnDiskThreshold(0)},
+		{OnDiskThreshold(0), Adaptive()},
+		{Sparse(), Atomic()},
+	} {
+		a, err := New(PageSize(32), NumValues(1000), opts[0])
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+		b, err := New(PageSize(32), NumValues(1000), opts[1])
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+		for index := uint64(0); index < 1000; index += 3 {
+			a.SetBitAt(index, true)
+			b.SetBitAt(index, true)
+		}
+
+		if eq, err := Equal(a, b); err != nil || !eq {
+			t.Errorf("Equal: expected true, got %v (error: %v)", eq, err)
+		}
+		if _, found, _ := FirstDifference(a, b); found {
+			t.Errorf("FirstDifference: expected none")
+		}
+		if c, _ := Compare(a, b); c != 0 {
+			t.Errorf("Compare: expected 0, got %d", c)
+		}
+
+		b.SetBitAt(700, true)
+		b.SetBitAt(998, true)
+		if index, found, err := FirstDifference(a, b); err != nil || !found || index != 700 {
+			t.Errorf("FirstDifference: expected 700, got %d, %v (error: %v)", index, found, err)
+		}
+		if eq, _ := Equal(a, b); eq {
+			t.Errorf("Equal: expected false")
+		}
+		if c, _ := Compare(a, b); c != -1 {
+			t.Errorf("Compare: expected -1, got %d", c)
+		}
+		if c, _ := Compare(b, a); c != +1 {
+			t.Errorf("Compare: expected +1, got %d", c)
+		}
+		if d, err := HammingDistance(a, b); err != nil || d != 2 {
+			t.Errorf("HammingDistance: expected 2, got %d (error: %v)", d, err)
+		}
+
+		b.SetBitAt(700, false)
+		b.SetBitAt(998, false)
+		b.Truncate(900)
+		if index, found, _ := FirstDifference(a, b); !found || index != 900 {
+			t.Errorf("FirstDifference: expected 900, got %d, %v", index, found)
+		}
+		if c, _ := Compare(b, a); c != -1 {
+			t.Errorf("Compare: expected a prefix to come first, got %d", c)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestBitVector_Sets(t *testing.T) {
+	for _, opts := range [][2]Option{
+		{OnDiskThreshold(1 << 20), OnDiskThreshold(0)},
+		{OnDiskThreshold(0), OnDiskThreshold(1 << 20)},
+	} {
+		vecs := make(map[uint64]BigBitVector)
+		for i, m := range []uint64{6, 3, 5} {
+			ba, err := New(PageSize(32), NumValues(1000), opts[i%2])
+			if err != nil {
+				t.Fatalf("New: error: %v", err)
+			}
+			for index := uint64(0); index < 1000; index += m {
+				ba.SetBitAt(index, true)
+			}
+			vecs[m] = ba
+		}
+		odd, err := New(PageSize(32), NumValues(1000), opts[1])
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+		for index := uint64(1); index < 1000; index += 2 {
+			odd.SetBitAt(index, true)
+		}
+
+		for _, c := range []struct {
+			name   string
+			fn     func(a, b BigBitVector) (bool, error)
+			a, b   BigBitVector
+			expect bool
+		}{
+			{"IsSubset", IsSubset, vecs[6], vecs[3], true},
+			{"IsSubset", IsSubset, vecs[3], vecs[6], false},
+			{"Intersects", Intersects, vecs[6], vecs[5], true},
+			{"Intersects", Intersects, vecs[6], odd, false},
+			{"Disjoint", Disjoint, vecs[6], odd, true},
+			{"Disjoint", Disjoint, vecs[3], odd, false},
+		} {
+			if got, err := c.fn(c.a, c.b); err != nil || got != c.expect {
+				t.Errorf("%s: expected %v, got %v (error: %v)", c.name, c.expect, got, err)
+			}
+		}
+
+		if n, err := IntersectionCount(vecs[3], vecs[5]); err != nil || n != 67 {
+			t.Errorf("IntersectionCount: expected 67, got %d (error: %v)", n, err)
+		}
+		if n, err := UnionCount(vecs[3], vecs[5]); err != nil || n != 467 {
+			t.Errorf("UnionCount: expected 467, got %d (error: %v)", n, err)
+		}
+		if j, err := Jaccard(vecs[3], vecs[5]); err != nil || j != 67.0/467.0 {
+			t.Errorf("Jaccard: expected %g, got %g (error: %v)", 67.0/467.0, j, err)
+		}
+		for _, ba := range vecs {
+			ba.Close()
+		}
+		odd.Close()
+	}
+}
+
+func TestBitVector_Shift(t *testing.T) {
+	const num = 1000
+	for _, opt := range []Option{OnDiskThreshold(1 << 20), OnDiskThreshold(0), Adaptive()} {
+		ba, err := New(PageSize(32), NumValues(num), opt)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+		model := make([]bool, num)
+		reset := func() {
+			x := uint64(12345)
+			for index := range model {
+				x = x*6364136223846793005 + 1442695040888963407
+				model[index] = (x>>33)%3 == 0
+				ba.SetBitAt(uint64(index), model[index])
+			}
+		}
+		check := func(what string, expect func(index int) bool) {
+			t.Helper()
+			for index := range model {
+				if bit, _ := ba.BitAt(uint64(index)); bit != expect(index) {
+					t.Errorf("%s: %d: expected %v, got %v", what, index, expect(index), bit)
+					return
+				}
+			}
+		}
+
+		for _, n := range []int{0, 1, 63, 300, 999, 1000, 1500} {
+			reset()
+			if err := ShiftLeft(ba, uint64(n)); err != nil {
+				t.Errorf("ShiftLeft %d: error: %v", n, err)
+			}
+			check(fmt.Sprintf("ShiftLeft %d", n), func(index int) bool {
+				return index+n < num && model[index+n]
+			})
+
+			reset()
+			if err := ShiftRight(ba, uint64(n)); err != nil {
+				t.Errorf("ShiftRight %d: error: %v", n, err)
+			}
+			check(fmt.Sprintf("ShiftRight %d", n), func(index int) bool {
+				return index >= n && model[index-n]
+			})
+		}
+
+		for _, n := range []int{0, 1, 100, 400, 500, 700, 950, 1003, -7, -400} {
+			reset()
+			if err := Rotate(ba, int64(n)); err != nil {
+				t.Errorf("Rotate %d: error: %v", n, err)
+			}
+			check(fmt.Sprintf("Rotate %d", n), func(index int) bool {
+				return model[((index+n)%num+num)%num]
+			})
+		}
+		ba.Close()
+	}
+}
+
+func TestBitVector_Reverse(t *testing.T) {
+	for _, opt := range []Option{OnDiskThreshold(1 << 20), OnDiskThreshold(0), Adaptive()} {
+		for _, num := range []uint64{0, 1, 8, 13, 1000, 1021} {
+			ba, err := New(PageSize(32), NumValues(num), opt)
+			if err != nil {
+				t.Fatalf("New: error: %v", err)
+			}
+			model := make([]bool, num)
+			x := uint64(num)
+			for index := range model {
+				x = x*6364136223846793005 + 1442695040888963407
+				model[index] = (x>>33)%3 == 0
+				ba.SetBitAt(uint64(index), model[index])
+			}
+
+			if err := Reverse(ba); err != nil {
+				t.Errorf("Reverse: error: %v", err)
+			}
+			for index := uint64(0); index < num; index++ {
+				if bit, _ := ba.BitAt(index); bit != model[num-1-index] {
+					t.Errorf("Reverse %d: %d: expected %v, got %v", num, index, model[num-1-index], bit)
+					break
+				}
+			}
+
+			if num >= 1000 {
+				i, j := uint64(5), uint64(900)
+				if err := ReverseRange(ba, i, j); err != nil {
+					t.Errorf("ReverseRange: error: %v", err)
+				}
+				for index := uint64(0); index < num; index++ {
+					src := num - 1 - index
+					if index >= i && index < j {
+						src = num - 1 - (i + j - 1 - index)
+					}
+					if bit, _ := ba.BitAt(index); bit != model[src] {
+						t.Errorf("ReverseRange %d: %d: expected %v, got %v", num, index, model[src], bit)
+						break
+					}
+				}
+				if err := ReverseRange(ba, 0, num+1); err != io.EOF {
+					t.Errorf("ReverseRange: expected io.EOF, got %v", err)
+				}
+			}
+			ba.Close()
+		}
+	}
+}
+
+func TestBitVector_CompactExpand(t *testing.T) {
+	const num = 1000
+	for _, opts := range [][3]Option{
+		{OnDiskThreshold(1 << 20), OnDiskThreshold(1 << 20), OnDiskThreshold(1 << 20)},
+		{OnDiskThreshold(1 << 20), OnDiskThreshold(0), OnDiskThreshold(0)},
+		{Adaptive(), OnDiskThreshold(0), Sparse()},
+	} {
+		src, _ := New(PageSize(32), NumValues(num), opts[1])
+		mask, _ := New(PageSize(32), NumValues(num), opts[2])
+		var want []bool
+		x := uint64(7)
+		for index := uint64(0); index < num; index++ {
+			x = x*6364136223846793005 + 1442695040888963407
+			bit := (x>>33)%2 == 0
+			// Mix long runs with scattered bits.
+			sel := (index >= 100 && index < 300) || (x>>40)%5 == 0
+			src.SetBitAt(index, bit)
+			mask.SetBitAt(index, sel)
+			if sel {
+				want = append(want, bit)
+			}
+		}
+
+		dst, _ := New(PageSize(32), NumValues(uint64(len(want))+10), opts[0])
+		dst.SetBitAt(uint64(len(want))+5, true)
+		n, err := Compact(dst, src, mask)
+		if err != nil || n != uint64(len(want)) {
+			t.Errorf("Compact: expected %d bits, got %d (error: %v)", len(want), n, err)
+		}
+		for k, bit := range want {
+			if got, _ := dst.BitAt(uint64(k)); got != bit {
+				t.Errorf("Compact: %d: expected %v, got %v", k, bit, got)
+				break
+			}
+		}
+		if bit, _ := dst.BitAt(uint64(len(want)) + 5); !bit {
+			t.Errorf("Compact: overwrote a bit past the end of the output")
+		}
+
+		short, _ := New(NumValues(uint64(len(want)) - 1))
+		if _, err := Compact(short, src, mask); err != io.EOF {
+			t.Errorf("Compact: expected io.EOF, got %v", err)
+		}
+
+		out, _ := New(PageSize(32), NumValues(num), opts[0])
+		for index := uint64(0); index < num; index++ {
+			out.SetBitAt(index, true)
+		}
+		n, err = Expand(out, dst, mask)
+		if err != nil || n != uint64(len(want)) {
+			t.Errorf("Expand: expected %d bits, got %d (error: %v)", len(want), n, err)
+		}
+		for index := uint64(0); index < num; index++ {
+			sel, _ := mask.BitAt(index)
+			bit, _ := src.BitAt(index)
+			if got, _ := out.BitAt(index); got != (sel && bit) {
+				t.Errorf("Expand: %d: expected %v, got %v", index, sel && bit, got)
+				break
+			}
+		}
+		if _, err := Expand(out, short, mask); err != io.EOF {
+			t.Errorf("Expand: expected io.EOF, got %v", err)
+		}
+
+		for _, ba := range []BigBitVector{src, mask, dst, short, out} {
+			ba.Close()
+		}
+	}
+}
+
+func TestBitVector_GatherScatter(t *testing.T) {
+	f, err := ioutil.TempFile("", "gather")
+	if err != nil {
+		t.Fatalf("TempFile: error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.Truncate(125)
+	var reads, writes int
+
+	disk, err := New(PageSize(32), NumValues(1000), WithFile(countingFile{f, &writes}))
+	if err != nil {
+		t.Fatalf("New: error: %v", err)
+	}
+	defer disk.Close()
+	for index := uint64(0); index < 1000; index += 7 {
+		disk.SetBitAt(index, true)
+	}
+	disk.Flush()
+
+	g, err := os.OpenFile(f.Name(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: error: %v", err)
+	}
+
+	// Pages 0, 1, and 3, in no particular order and with a repeat.
+	idx := []uint64{900, 3, 260, 14, 999, 7, 511, 256, 3, 800, 0}
+	for _, opts := range [][]Option{
+		{OnDiskThreshold(1 << 20)},
+		{WithFile(readCountingFile{g, &reads})},
+		{Adaptive()},
+	} {
+		ba, err := New(append(opts, PageSize(32), NumValues(1000))...)
+		if err != nil {
+			t.Fatalf("New: error: %v", err)
+		}
+		if _, ok := ba.(*onDiskArray); !ok {
+			for index := uint64(0); index < 1000; index += 7 {
+				ba.SetBitAt(index, true)
+			}
+		}
+
+		reads = 0
+		out := make([]bool, len(idx))
+		if err := Gather(ba, idx, out); err != nil {
+			t.Errorf("Gather: error: %v", err)
+		}
+		for k, index := range idx {
+			if out[k] != (index%7 == 0) {
+				t.Errorf("Gather: %d: expected %v, got %v", index, index%7 == 0, out[k])
+			}
+		}
+		if _, ok := ba.(*onDiskArray); ok && reads != 3 {
+			t.Errorf("Gather: expected 3 page reads, got %d", reads)
+		}
+		if err := Gather(ba, []uint64{5, 1000}, out); err != io.EOF {
+			t.Errorf("Gather: expected io.EOF, got %v", err)
+		}
+		ba.Close()
+	}
+
+	writes = 0
+	if err := Scatter(disk, idx, true); err != nil {
+		t.Errorf("Scatter: error: %v", err)
+	}
+	if writes != 3 {
+		t.Errorf("Scatter: expected 3 page writes, got %d", writes)
+	}
+	for _, index := range idx {
+		if bit, _ := disk.BitAt(index); !bit {
+			t.Errorf("Scatter: %d: expected true", index)
+		}
+	}
+	if err := Scatter(disk, idx[0:4], false); err != nil {
+		t.Errorf("Scatter: error: %v", err)
+	}
+	for k, index := range idx {
+		if bit, _ := disk.BitAt(index); bit != (k >= 4 && index != 3) {
+			t.Errorf("Scatter: %d: expected %v, got %v", index, k >= 4 && index != 3, bit)
+		}
+	}
+}
@@ -1,27 +1,57 @@
 package bigbitvector
 
 import (
+	"container/list"
+	"context"
 	"fmt"
 	"io"
 	"sync"
 )
 
 type cachePage struct {
+	bv     *onDiskArray
+	elem   *list.Element
 	buf    []byte
 	data   []byte
 	off    uint64
+	wb     chan struct{}
 	refcnt uint32
 	dirty  bool
 }
 
+// markDirty marks the page as modified.  Until the page is written back, the
+// uniform map no longer describes it, so SetBitAt and BitAt must not take
+// their shortcuts around the cached copy.
+func (page *cachePage) markDirty() {
+	if !page.dirty {
+		page.dirty = true
+		page.bv.uni.forget(page.off / uint64(page.bv.psz))
+	}
+}
+
+// maxFreePages bounds the number of unused pages, with their buffers, that an
+// onDiskArray keeps around for reuse.
+const maxFreePages = 4
+
 type onDiskArray struct {
+	mu    sync.Mutex
 	f     File
 	p     *sync.Pool
+	pc    *PageCache
+	ck    File
+	lf    File
 	cache map[uint64]*cachePage
+	free  []*cachePage
+	stuck []*cachePage
+	uni   uniformMap
+	async asyncState
 	num   uint64
 	psz   uint
+	ra    uint
 	ro    bool
+	pl    bool
 	doc   bool
+	dck   bool
 }
 
 func (bv *onDiskArray) Frozen() bool {
@@ -40,6 +70,21 @@ func (bv *onDiskArray) BitAt(index uint64) (bool, error) {
 	var tmp [1]byte
 	b, m := byteAndMask(index)
 
+	if known, ones := bv.uni.get(b / uint64(bv.psz)); known {
+		return ones, nil
+	}
+
+	if bv.ck != nil || bv.pl {
+		page, err := bv.acquirePage(bv.pageOffset(b))
+		if err != nil {
+			return false, err
+		}
+		bit := (page.data[b-page.off] & m) != 0
+		bv.disposePage(page)
+		return bit, nil
+	}
+
+	bv.waitPage(bv.pageOffset(b))
 	_, err := bv.f.ReadAt(tmp[:], int64(b))
 	if err != nil {
 		return false, err
@@ -59,6 +104,32 @@ func (bv *onDiskArray) SetBitAt(index uint64, bit bool) error {
 	var tmp [1]byte
 	b, m := byteAndMask(index)
 
+	if known, ones := bv.uni.get(b / uint64(bv.psz)); known && ones == bit {
+		return nil
+	}
+
+	if bv.ck != nil || bv.pl {
+		page, err := bv.acquirePage(bv.pageOffset(b))
+		if err != nil {
+			return err
+		}
+		ref := &page.data[b-page.off]
+		if bit {
+			*ref |= m
+		} else {
+			*ref &= ^m
+		}
+		page.markDirty()
+		if err := flushPage(bv, page); err != nil {
+			// Keep the write for the next Flush or Close to retry.
+			bv.keepStuck(page)
+			return err
+		}
+		bv.disposePage(page)
+		return nil
+	}
+
+	bv.waitPage(bv.pageOffset(b))
 	_, err := bv.f.ReadAt(tmp[:], int64(b))
 	if err != nil {
 		return err
@@ -70,14 +141,14 @@ func (bv *onDiskArray) SetBitAt(index uint64, bit bool) error {
 		tmp[0] &= ^m
 	}
 
+	bv.uni.forget(b / uint64(bv.psz))
+	bv.noteWrite(bv.pageOffset(b))
 	_, err = bv.f.WriteAt(tmp[:], int64(b))
-	for _, page := range bv.cache {
-		end := page.off + uint64(len(page.data))
-		if b >= page.off && b < end {
-			b -= page.off
-			page.data[b] = tmp[0]
-		}
+	bv.lock()
+	if page, found := bv.cache[bv.pageOffset(b)]; found && b-page.off < uint64(len(page.data)) {
+		page.data[b-page.off] = tmp[0]
 	}
+	bv.unlock()
 	return err
 }
 
@@ -121,11 +192,19 @@ func (bv *onDiskArray) Truncate(length uint64) error {
 	if length > bv.Len() {
 		panic("cannot grow a bit array")
 	}
-	if len(bv.cache) != 0 {
+	if err := bv.retryStuck(false); err != nil {
+		return err
+	}
+	if !bv.dropCache() {
 		panic("Truncate() with live iterators is undefined behavior")
 	}
 	lengthBytes := (length + 7) / 8
+	psz := uint64(bv.psz)
 	bv.num = length
+	bv.uni.truncate((lengthBytes + psz - 1) / psz)
+	if bv.ck != nil {
+		return bv.truncateWithChecksums(lengthBytes)
+	}
 	return bv.f.Truncate(int64(lengthBytes))
 }
 
@@ -137,8 +216,9 @@ func (bv *onDiskArray) Freeze() error {
 func (bv *onDiskArray) Flush() error {
 	type flusher interface{ Flush() error }
 
-	var finalError error
-	for _, page := range bv.cache {
+	finalError := bv.retryStuck(false)
+	for _, page := range bv.pinnedPages() {
+		page.wait()
 		if err := flushPage(bv, page); err != nil && finalError == nil {
 			finalError = err
 		}
@@ -148,6 +228,11 @@ func (bv *onDiskArray) Flush() error {
 			finalError = err
 		}
 	}
+	if f, ok := bv.ck.(flusher); ok {
+		if err := f.Flush(); finalError == nil {
+			finalError = err
+		}
+	}
 	return finalError
 }
 
@@ -166,82 +251,354 @@ func (bv *onDiskArray) Sync() error {
 func (bv *onDiskArray) Close() error {
 	needClose := true
 	defer func() {
-		if needClose && bv.doc {
-			removeFile(bv.f)
-		} else if needClose {
-			bv.f.Close()
+		if needClose {
+			closeFile(bv.f, bv.doc)
+			if bv.ck != nil {
+				closeFile(bv.ck, bv.dck)
+			}
 		}
 	}()
 
-	if len(bv.cache) != 0 {
+	err := bv.retryStuck(true)
+	if !bv.dropCache() {
 		panic("BigBitVector.Close called with outstanding iterators")
 	}
-
-	if bv.doc {
-		needClose = false
-		return removeFile(bv.f)
-	}
+	bv.unlockFile()
 
 	needClose = false
-	return bv.f.Close()
+	if err2 := closeFile(bv.f, bv.doc); err == nil {
+		err = err2
+	}
+	if bv.ck != nil {
+		if err2 := closeFile(bv.ck, bv.dck); err == nil {
+			err = err2
+		}
+	}
+	return err
 }
 
 func (bv *onDiskArray) Debug() string {
 	return debugImpl(bv)
 }
 
+// lock guards the page cache, which iterators over disjoint pages may use in
+// parallel.  A shared PageCache has a single lock for all of its bitvectors.
+func (bv *onDiskArray) lock() {
+	if bv.pc != nil {
+		bv.pc.mu.Lock()
+	} else {
+		bv.mu.Lock()
+	}
+}
+
+func (bv *onDiskArray) unlock() {
+	if bv.pc != nil {
+		bv.pc.mu.Unlock()
+	} else {
+		bv.mu.Unlock()
+	}
+}
+
+// keepStuck holds on to a dirty page whose write-back failed, so that the
+// next Flush or Close tries again instead of losing the write.
+func (bv *onDiskArray) keepStuck(page *cachePage) {
+	bv.lock()
+	bv.stuck = append(bv.stuck, page)
+	bv.unlock()
+}
+
+// retryStuck tries again to write back the pages held by keepStuck, and lets
+// go of those which succeed.  If drop is true, it lets go of the others too,
+// discarding their writes.  It returns the first error.
+func (bv *onDiskArray) retryStuck(drop bool) error {
+	bv.lock()
+	pages := bv.stuck
+	bv.stuck = nil
+	bv.unlock()
+
+	var finalError error
+	for _, page := range pages {
+		if err := flushPage(bv, page); err != nil {
+			if finalError == nil {
+				finalError = err
+			}
+			if !drop {
+				bv.keepStuck(page)
+				continue
+			}
+			page.dirty = false
+		}
+		bv.disposePage(page)
+	}
+	return finalError
+}
+
+// pinnedPages returns the pages that are currently in use by iterators.
+func (bv *onDiskArray) pinnedPages() []*cachePage {
+	bv.lock()
+	defer bv.unlock()
+	pages := make([]*cachePage, 0, len(bv.cache))
+	for _, page := range bv.cache {
+		if page.refcnt != 0 {
+			pages = append(pages, page)
+		}
+	}
+	return pages
+}
+
+// dropCache discards any idle pages kept by the shared PageCache.  It returns
+// false if some pages are still pinned.
+func (bv *onDiskArray) dropCache() bool {
+	bv.lock()
+	defer bv.unlock()
+	for _, page := range bv.cache {
+		if page.refcnt != 0 {
+			return false
+		}
+	}
+	for _, page := range bv.cache {
+		bv.pc.drop(page)
+	}
+	for i, page := range bv.free {
+		bv.putBuffer(page.buf)
+		bv.free[i] = nil
+	}
+	bv.free = bv.free[:0]
+	return true
+}
+
 func (bv *onDiskArray) acquirePage(off uint64) (*cachePage, error) {
-	page, found := bv.cache[off]
-	if found {
-		page.refcnt++
+	return bv.acquirePageContext(context.Background(), off)
+}
+
+// acquirePageContext is acquirePage, but fails with the context's error
+// instead of starting a read once the context is done.
+func (bv *onDiskArray) acquirePageContext(ctx context.Context, off uint64) (*cachePage, error) {
+	if page := bv.lookupPage(off); page != nil {
 		return page, nil
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := bv.reservePage(); err != nil {
+		return nil, err
+	}
 
-	var bb []byte
-	if bv.p != nil {
-		bb = bv.p.Get().([]byte)
+	if err := bv.lockPage(off); err != nil {
+		bv.unreservePage()
+		return nil, err
 	}
 
-	var b []byte
-	if uint(cap(bb)) >= bv.psz {
-		b = bb[0:bv.psz]
-	} else {
-		b = make([]byte, bv.psz)
+	page := bv.newPage()
+	b := page.data
+	n, found := bv.fillUniform(off, b)
+	if !found {
+		var err error
+		n, err = bv.readPage(off, b)
+		if err != nil {
+			bv.unlockPage(off)
+			bv.lock()
+			bv.freePage(page)
+			bv.unlock()
+			bv.unreservePage()
+			return nil, err
+		}
+		bv.uni.classify(off/uint64(bv.psz), b[0:n])
 	}
 
-	n, err := bv.f.ReadAt(b, int64(off))
-	if err != nil && err != io.EOF {
-		return nil, err
+	page.data = b[0:n]
+	page.off = off
+	page.refcnt = 1
+	bv.lock()
+	bv.cache[off] = page
+	bv.unlock()
+	return page, nil
+}
+
+// newPage returns an unused page with a page-sized buffer, taking it from the
+// free list if possible.
+func (bv *onDiskArray) newPage() *cachePage {
+	bv.lock()
+	defer bv.unlock()
+	if n := len(bv.free); n != 0 {
+		page := bv.free[n-1]
+		bv.free[n-1] = nil
+		bv.free = bv.free[:n-1]
+		return page
+	}
+	bb, b := bv.getBuffer()
+	return &cachePage{bv: bv, buf: bb, data: b}
+}
+
+// freePage puts a page which has left the cache on the free list, or returns
+// its buffer to the pool if the free list is full.  The caller must hold the
+// lock.
+func (bv *onDiskArray) freePage(page *cachePage) {
+	if len(bv.free) < maxFreePages && uint(cap(page.data)) >= bv.psz {
+		*page = cachePage{bv: bv, buf: page.buf, data: page.data[0:bv.psz]}
+		bv.free = append(bv.free, page)
+		return
+	}
+	bv.putBuffer(page.buf)
+	*page = cachePage{}
+}
+
+// lookupPage returns page off with an extra reference, or nil if the page is
+// not in the cache.
+func (bv *onDiskArray) lookupPage(off uint64) *cachePage {
+	bv.lock()
+	defer bv.unlock()
+	page, found := bv.cache[off]
+	if !found {
+		return nil
 	}
-	b = b[0:n]
+	if bv.pc != nil {
+		bv.pc.hit(page)
+	}
+	page.refcnt++
+	return page
+}
+
+func (bv *onDiskArray) isCached(off uint64) bool {
+	bv.lock()
+	defer bv.unlock()
+	_, found := bv.cache[off]
+	return found
+}
 
-	page = &cachePage{
+func (bv *onDiskArray) insertPage(off uint64, bb, b []byte) *cachePage {
+	page := &cachePage{
+		bv:     bv,
 		buf:    bb,
 		data:   b,
 		off:    off,
 		refcnt: 1,
 		dirty:  false,
 	}
+	bv.lock()
 	bv.cache[off] = page
-	return page, nil
+	bv.unlock()
+	return page
+}
+
+func (bv *onDiskArray) reservePage() error {
+	if bv.pc == nil {
+		return nil
+	}
+	bv.lock()
+	defer bv.unlock()
+	return bv.pc.reserve(uint64(bv.psz))
+}
+
+func (bv *onDiskArray) unreservePage() {
+	if bv.pc == nil {
+		return
+	}
+	bv.lock()
+	defer bv.unlock()
+	bv.pc.unreserve(uint64(bv.psz))
+}
+
+// getBuffer returns a page-sized buffer b, along with the pool buffer bb that
+// backs it (if any).
+func (bv *onDiskArray) getBuffer() (bb, b []byte) {
+	if bv.p != nil {
+		bb = bv.p.Get().([]byte)
+	}
+	if uint(cap(bb)) >= bv.psz {
+		b = bb[0:bv.psz]
+	} else {
+		b = make([]byte, bv.psz)
+	}
+	return bb, b
+}
+
+func (bv *onDiskArray) putBuffer(bb []byte) {
+	if bv.p != nil && bb != nil {
+		bv.p.Put(bb)
+	}
+}
+
+// readPage reads and verifies page off into b.  It is safe to call from an
+// iterator's I/O goroutine.
+func (bv *onDiskArray) readPage(off uint64, b []byte) (int, error) {
+	n, err := bv.f.ReadAt(b, int64(off))
+	if err == nil || err == io.EOF {
+		err = bv.verifyPage(off, b[0:n])
+	}
+	return n, err
+}
+
+// writePage writes data back to page off, punching a hole instead if zero is
+// true and the platform supports it.  It is safe to call from an iterator's
+// I/O goroutine.
+func (bv *onDiskArray) writePage(off uint64, data []byte, zero bool) error {
+	if !zero || !punchHole(bv.f, off, uint64(len(data))) {
+		if _, err := bv.f.WriteAt(data, int64(off)); err != nil {
+			return err
+		}
+	}
+	return bv.storeChecksum(off, data)
+}
+
+// waitPage waits for any write-behind of page off to complete.  The page
+// may be evicted as soon as the lock is dropped, so only its channel is kept.
+func (bv *onDiskArray) waitPage(off uint64) {
+	var wb chan struct{}
+	bv.lock()
+	if page := bv.cache[off]; page != nil {
+		wb = page.wb
+	}
+	bv.unlock()
+	if wb != nil {
+		<-wb
+	}
+}
+
+func (bv *onDiskArray) pageOffset(b uint64) uint64 {
+	psz := uint64(bv.psz)
+	return (b / psz) * psz
 }
 
 func (bv *onDiskArray) disposePage(page *cachePage) {
 	if page == nil {
 		return
 	}
+	bv.lock()
+	defer bv.unlock()
+	page.refcnt--
+	if page.refcnt > 0 {
+		return
+	}
 	if page.dirty {
 		panic("cannot dispose of a dirty page")
 	}
-	page.refcnt--
-	if page.refcnt > 0 {
+	if bv.pc != nil && bv.pl {
+		// Parking the page would keep it locked while idle, and once
+		// unlocked, its contents can't be trusted; let it go instead, so
+		// that the next acquire locks and reads it afresh.
+		bv.pc.drop(page)
+		return
+	}
+	if bv.pc != nil {
+		bv.pc.park(page)
 		return
 	}
 	delete(bv.cache, page.off)
-	if bv.p != nil && page.buf != nil {
-		bv.p.Put(page.buf)
+	bv.unlockPage(page.off)
+	bv.freePage(page)
+}
+
+// wait blocks until the page's pending write-behind, if any, has completed.
+// The caller must hold a reference to the page.
+func (page *cachePage) wait() {
+	bv := page.bv
+	bv.lock()
+	wb := page.wb
+	bv.unlock()
+	if wb != nil {
+		<-wb
 	}
-	*page = cachePage{}
 }
 
 var _ BigBitVector = (*onDiskArray)(nil)
@@ -249,6 +606,8 @@ var _ BigBitVector = (*onDiskArray)(nil)
 type onDiskIterator struct {
 	bv   *onDiskArray
 	page *cachePage
+	aio  *asyncIO
+	ctx  context.Context
 	err  error
 	pos  uint64
 	end  uint64
@@ -292,13 +651,17 @@ func (iter *onDiskIterator) Skip(n uint64) bool {
 		index = iter.pos
 	}
 
-	psz := uint64(iter.bv.psz)
 	b, m := byteAndMask(index)
-	pageOffset := (b / psz) * psz
+	pageOffset := iter.bv.pageOffset(b)
 
 	page := iter.page
 	if page != nil && page.off != pageOffset {
-		err := flushPage(iter.bv, page)
+		var err error
+		if iter.aio != nil && page.dirty {
+			err = iter.aio.writeBehind(page)
+		} else {
+			err = flushPage(iter.bv, page)
+		}
 		if err != nil {
 			iter.err = err
 			iter.val = false
@@ -310,7 +673,7 @@ func (iter *onDiskIterator) Skip(n uint64) bool {
 	}
 	if page == nil {
 		var err error
-		page, err = iter.bv.acquirePage(pageOffset)
+		page, err = iter.acquirePage(pageOffset)
 		if err != nil {
 			iter.err = err
 			iter.val = false
@@ -344,20 +707,83 @@ func (iter *onDiskIterator) SetBit(bit bool) {
 	} else {
 		*ref &= ^m
 	}
-	iter.page.dirty = true
+	iter.page.markDirty()
+}
+
+// acquirePage acquires page off, through the read-ahead goroutine if the
+// bitvector has one configured.
+func (iter *onDiskIterator) acquirePage(off uint64) (*cachePage, error) {
+	bv := iter.bv
+	ctx := iter.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if bv.ra == 0 {
+		return bv.acquirePageContext(ctx, off)
+	}
+	if iter.aio == nil {
+		var last uint64
+		if iter.down {
+			last = iter.end / 8
+		} else {
+			last = (iter.end - 1) / 8
+		}
+		iter.aio = newAsyncIO(bv, bv.pageOffset(last), iter.down)
+	}
+	return iter.aio.acquirePage(ctx, off)
+}
+
+func (iter *onDiskIterator) bindContext(ctx context.Context) {
+	iter.ctx = ctx
 }
 
 func (iter *onDiskIterator) Flush() error {
-	return flushPage(iter.bv, iter.page)
+	err := flushPage(iter.bv, iter.page)
+	if iter.aio != nil {
+		if err2 := iter.aio.drain(); err == nil {
+			err = err2
+		}
+	}
+	return err
 }
 
 func (iter *onDiskIterator) Close() error {
-	err := iter.Flush()
+	err := iter.release()
 	if iter.err != nil {
 		err = iter.err
 	}
-	iter.bv.disposePage(iter.page)
-	*iter = onDiskIterator{err: ErrClosedIterator}
+	*iter = onDiskIterator{bv: iter.bv, err: ErrClosedIterator}
+	return err
+}
+
+func (iter *onDiskIterator) Reset(i, j uint64, reverse bool) error {
+	if i > j {
+		panic(fmt.Errorf("onDiskIterator.Reset: i > j: i=%d j=%d", i, j))
+	}
+	err := iter.release()
+	if reverse {
+		*iter = onDiskIterator{bv: iter.bv, ctx: iter.ctx, pos: j + 1, end: i, down: true}
+	} else {
+		*iter = onDiskIterator{bv: iter.bv, ctx: iter.ctx, pos: i - 1, end: j}
+	}
+	return err
+}
+
+// release flushes the iterator's writes and gives up its page.
+func (iter *onDiskIterator) release() error {
+	err := iter.Flush()
+	if iter.aio != nil {
+		iter.aio.close()
+	}
+	if iter.page != nil {
+		if iter.page.dirty {
+			// Flush failed to write the page back; keep the write
+			// for the next Flush or Close to retry.
+			iter.bv.keepStuck(iter.page)
+		} else {
+			iter.bv.disposePage(iter.page)
+		}
+	}
 	return err
 }
 
@@ -365,8 +791,12 @@ var _ Iterator = (*onDiskIterator)(nil)
 
 func flushPage(bv *onDiskArray, page *cachePage) error {
 	if page != nil && page.dirty {
-		_, err := bv.f.WriteAt(page.data, int64(page.off))
-		if err != nil {
+		page.wait()
+		idx := page.off / uint64(bv.psz)
+		zero := bv.uni.classify(idx, page.data)
+		bv.noteWrite(page.off)
+		if err := bv.writePage(page.off, page.data, zero); err != nil {
+			bv.uni.forget(idx)
 			return err
 		}
 		page.dirty = false
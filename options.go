@@ -14,11 +14,25 @@ const (
 type options struct {
 	numValues          uint64
 	diskThreshold      uint64
+	density            float64
 	backingFile        File
+	checksumFile       File
 	bufferPool         *sync.Pool
+	pageCache          *PageCache
+	memoryBudget       func() bool
+	encryptionKey      []byte
+	codec              Codec
 	pageSize           uint
+	readAhead          uint
 	diskThresholdIsSet bool
 	isReadOnly         bool
+	useChecksums       bool
+	isAdaptive         bool
+	isSparse           bool
+	isHybrid           bool
+	isAtomic           bool
+	useLocking         bool
+	usePageLocks       bool
 }
 
 func (o *options) apply(opts ...Option) {
@@ -28,6 +42,10 @@ func (o *options) apply(opts ...Option) {
 }
 
 func (o *options) populate() {
+	if o.density > 0 && o.density < sparseDensityCutoff {
+		o.isSparse = true
+	}
+
 	if !o.diskThresholdIsSet {
 		o.diskThreshold = defaultOnDiskThreshold
 	}
@@ -40,15 +58,31 @@ func (o *options) populate() {
 func (o options) debugString() string {
 	hasFile := (o.backingFile != nil)
 	hasPool := (o.bufferPool != nil)
+	hasCache := (o.pageCache != nil)
+	hasKey := (o.encryptionKey != nil)
+	hasBudget := (o.memoryBudget != nil)
 	return fmt.Sprintf(
-		"{num:%d odt:%d odtset:%v psz:%d file:%v pool:%v ro:%v}",
+		"{num:%d odt:%d odtset:%v psz:%d ra:%d file:%v pool:%v cache:%v ro:%v crc:%v enc:%v zip:%v adapt:%v sparse:%v density:%g hybrid:%v atomic:%v lock:%v plock:%v budget:%v}",
 		o.numValues,
 		o.diskThreshold,
 		o.diskThresholdIsSet,
 		o.pageSize,
+		o.readAhead,
 		hasFile,
 		hasPool,
-		o.isReadOnly)
+		hasCache,
+		o.isReadOnly,
+		o.useChecksums,
+		hasKey,
+		o.codec,
+		o.isAdaptive,
+		o.isSparse,
+		o.density,
+		o.isHybrid,
+		o.isAtomic,
+		o.useLocking,
+		o.usePageLocks,
+		hasBudget)
 }
 
 // Option is a behavior customization for New.
@@ -83,6 +117,19 @@ func PageSize(size uint) Option {
 	return func(o *options) { o.pageSize = size }
 }
 
+// ReadAhead gives each iterator over an on-disk bitvector a background
+// goroutine which reads up to n pages ahead of it, in the direction of
+// iteration, and writes dirty pages back behind it.  Each iterator has at most
+// n pages being read ahead and at most n pages waiting to be written.  Errors
+// from background writes are returned by the iterator's Err, Flush, or Close.
+//
+// The backing File must allow concurrent calls to ReadAt and WriteAt, as
+// *os.File does.
+//
+func ReadAhead(n uint) Option {
+	return func(o *options) { o.readAhead = n }
+}
+
 // WithPool specifies a buffer pool to use for disk I/O.  The pool must contain
 // []byte slices with a capacity at least as large as the value for PageSize.
 //
@@ -90,6 +137,14 @@ func WithPool(pool *sync.Pool) Option {
 	return func(o *options) { o.bufferPool = pool }
 }
 
+// WithCache specifies a PageCache to keep pages in for disk I/O.  Many
+// bitvectors can share the same PageCache, which bounds the memory used by
+// all of their pages together.
+//
+func WithCache(cache *PageCache) Option {
+	return func(o *options) { o.pageCache = cache }
+}
+
 // WithFile specifies the read-write file handle which will back the array.
 func WithFile(file File) Option {
 	return func(p *options) { p.backingFile = file }
@@ -102,3 +157,149 @@ func WithReadOnlyFile(file io.ReaderAt) Option {
 		p.isReadOnly = true
 	}
 }
+
+// Locking makes New take a POSIX advisory lock on the file given to WithFile
+// or WithReadOnlyFile, so that several processes can share it safely: a
+// shared lock if the bitvector is read-only, or an exclusive lock otherwise.
+// The lock is released by Close.  If another process holds a conflicting
+// lock, New fails with a *LockError naming that process.
+//
+// Advisory locks only exclude other processes which also use them.  Locks
+// belong to the process, so opening the same file twice within one process
+// does not conflict, and closing any descriptor for the file releases them.
+// Locking is only supported for *os.File on Linux.
+//
+func Locking() Option {
+	return func(p *options) { p.useLocking = true }
+}
+
+// PageLocking is like Locking, but lets several processes update disjoint
+// regions of the same file.  Instead of locking the whole file, each page is
+// locked while it is loaded, and loading a page which another process has
+// locked fails with a *LockError.  Pages are loaded through the cache on
+// every access, and ReadAhead is ignored.  A process holding a whole-file
+// exclusive lock excludes all page-locking processes.
+//
+// With WithCache, pages are unlocked and dropped from the PageCache as soon
+// as they are no longer in use.  PageLocking cannot be combined with
+// Encrypted or Compressed, whose files have metadata shared by all pages.
+//
+func PageLocking() Option {
+	return func(p *options) {
+		p.useLocking = true
+		p.usePageLocks = true
+	}
+}
+
+// WithChecksums enables per-page CRC32C checksums for on-disk arrays.  The
+// checksums are kept in the given side table, 8 bytes per page, and are
+// verified whenever a page is loaded from disk.
+//
+// If table is nil, a temporary side table is created and removed when the
+// array is closed.  With WithFile or WithReadOnlyFile, it is first filled in
+// from the file's current contents, which are trusted.  If table is not a
+// File, it is treated as read-only.
+//
+func WithChecksums(table io.ReaderAt) Option {
+	return func(p *options) {
+		p.useChecksums = true
+		p.checksumFile = nil
+		if f, ok := table.(File); ok {
+			p.checksumFile = f
+		} else if table != nil {
+			p.checksumFile = wrappedReaderAt{table}
+		}
+	}
+}
+
+// Encrypted enables at-rest encryption for on-disk arrays.  Each page is
+// sealed with AES-GCM under a key derived from the given AES key (16, 24, or
+// 32 bytes) and a random per-file salt.  The checksum side table, if any, is
+// encrypted as well.
+//
+// Encrypted files have their own on-disk format and must always be reopened
+// with the same key and PageSize.  A file passed to WithFile must either be
+// empty or have been written previously by an encrypted array; empty files
+// are sized automatically.
+//
+func Encrypted(key []byte) Option {
+	return func(p *options) { p.encryptionKey = key }
+}
+
+// Compressed enables transparent page compression for on-disk arrays.  Each
+// page is compressed separately with the given codec, and pages that are
+// entirely zero take no space at all.
+//
+// Compressed files have their own on-disk format and must always be reopened
+// with the same PageSize; the codec recorded in an existing file takes
+// precedence.  A file passed to WithFile must either be empty or have been
+// written previously by a compressed array; empty files are sized
+// automatically.  When combined with Encrypted, pages are compressed before
+// they are encrypted.
+//
+func Compressed(codec Codec) Option {
+	return func(p *options) { p.codec = codec }
+}
+
+// Adaptive selects a bitvector implementation that splits the bits into
+// fixed-size chunks and stores each chunk as a sorted array of set positions,
+// a raw bitmap, or a list of runs, whichever is smallest.  Chunks are
+// converted automatically as their density changes.
+//
+// Once the chunks held in memory exceed OnDiskThreshold, the least recently
+// used ones are spilled to a private temporary file.  Adaptive is ignored if
+// WithFile or WithReadOnlyFile is given.
+//
+func Adaptive() Option {
+	return func(p *options) { p.isAdaptive = true }
+}
+
+// Sparse selects a bitvector implementation that stores only the positions of
+// the set bits, in a B+tree whose leaves are spilled to a private temporary
+// file once they exceed OnDiskThreshold.  It is suited to vectors where only
+// a tiny fraction of the bits are ever set.  Sparse is ignored if WithFile or
+// WithReadOnlyFile is given.
+//
+func Sparse() Option {
+	return func(p *options) { p.isSparse = true }
+}
+
+// ExpectedDensity hints at the fraction of bits (between 0 and 1) that are
+// expected to be set.  Vectors expected to be very sparse are created as if
+// Sparse had been given.
+//
+func ExpectedDensity(density float64) Option {
+	return func(p *options) { p.density = density }
+}
+
+// Hybrid selects a bitvector implementation that migrates transparently
+// between memory and a temporary file.  It starts out in memory or on disk
+// according to OnDiskThreshold, spills to disk when it is larger than
+// OnDiskThreshold or when the MemoryBudget callback reports pressure, and
+// loads itself back into memory when Truncate shrinks it below
+// OnDiskThreshold.  Live iterators keep working across migrations.
+//
+// Hybrid is ignored if WithFile or WithReadOnlyFile is given.
+//
+func Hybrid() Option {
+	return func(p *options) { p.isHybrid = true }
+}
+
+// Atomic selects an in-memory bitvector whose bits may be read and written
+// from many goroutines at once.  The bitvector returned by New implements
+// AtomicBitVector.  Atomic bitvectors always live in memory, regardless of
+// OnDiskThreshold.
+//
+// Atomic is ignored if WithFile or WithReadOnlyFile is given.
+//
+func Atomic() Option {
+	return func(p *options) { p.isAtomic = true }
+}
+
+// MemoryBudget specifies a callback that returns true while the process is
+// under memory pressure.  Hybrid bitvectors poll it periodically and spill
+// to disk while it returns true.
+//
+func MemoryBudget(fn func() bool) Option {
+	return func(p *options) { p.memoryBudget = fn }
+}
@@ -0,0 +1,120 @@
+package bigbitvector
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+// ErrCacheExhausted is returned when a page cannot be loaded because the
+// PageCache budget is entirely taken up by pages that are in use.
+var ErrCacheExhausted = errors.New("page cache budget exhausted by pinned pages")
+
+// PageCache is a page cache that can be shared by many on-disk bitvectors
+// through WithCache.  It keeps pages around after the last iterator using them
+// has moved on, and enforces a total byte budget across all of its bitvectors
+// by evicting the least recently used unpinned pages.
+//
+// A PageCache is safe for concurrent use by bitvectors on different
+// goroutines.
+//
+type PageCache struct {
+	mu        sync.Mutex
+	lru       list.List
+	budget    uint64
+	bytes     uint64
+	pages     uint64
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// PageCacheStats is a snapshot of a PageCache's counters.
+type PageCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Bytes     uint64
+	Pages     uint64
+}
+
+// NewPageCache constructs a PageCache which holds at most budget bytes of
+// pages.
+func NewPageCache(budget uint64) *PageCache {
+	return &PageCache{budget: budget}
+}
+
+// Stats returns the cache's hit, miss, and eviction counters along with its
+// current size.
+func (c *PageCache) Stats() PageCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return PageCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Bytes:     c.bytes,
+		Pages:     c.pages,
+	}
+}
+
+// The methods below must be called with c.mu held.
+
+// hit records a lookup that found page, pinning it if it was idle.
+func (c *PageCache) hit(page *cachePage) {
+	c.hits++
+	if page.elem != nil {
+		c.lru.Remove(page.elem)
+		page.elem = nil
+	}
+}
+
+// reserve records a lookup that missed, and makes room for a page of n bytes.
+func (c *PageCache) reserve(n uint64) error {
+	c.misses++
+	for c.bytes+n > c.budget && c.lru.Len() != 0 {
+		c.evict(c.lru.Back().Value.(*cachePage))
+	}
+	if c.bytes+n > c.budget {
+		return ErrCacheExhausted
+	}
+	c.bytes += n
+	c.pages++
+	return nil
+}
+
+func (c *PageCache) unreserve(n uint64) {
+	c.bytes -= n
+	c.pages--
+}
+
+// park makes page, which is no longer pinned, eligible for eviction.
+func (c *PageCache) park(page *cachePage) {
+	page.elem = c.lru.PushFront(page)
+	for c.bytes > c.budget && c.lru.Len() != 0 {
+		c.evict(c.lru.Back().Value.(*cachePage))
+	}
+}
+
+// evict removes an idle page from the cache and from its bitvector.
+func (c *PageCache) evict(page *cachePage) {
+	c.drop(page)
+	c.evictions++
+}
+
+func (c *PageCache) drop(page *cachePage) {
+	bv := page.bv
+	if page.wb != nil {
+		// Pages stay pinned while written behind, so this shouldn't
+		// happen; but never let a stale write land after the page
+		// has gone.  The I/O goroutines don't take c.mu.
+		<-page.wb
+	}
+	if page.elem != nil {
+		c.lru.Remove(page.elem)
+	}
+	delete(bv.cache, page.off)
+	bv.unlockPage(page.off)
+	c.unreserve(uint64(bv.psz))
+	bv.freePage(page)
+}
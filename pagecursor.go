@@ -0,0 +1,183 @@
+package bigbitvector
+
+// genericPageSize is the size of the pages that are emulated for bitvectors
+// which don't store their bits as packed bytes.
+const genericPageSize = 4096
+
+// pageCursor gives access to the packed bytes of a bitvector, one page at a
+// time.  Only one page is loaded at once; loading another page writes back the
+// previous one if it was marked dirty.
+type pageCursor interface {
+	// load makes the page containing byte off current, and returns the
+	// offset of its first byte along with its contents.  The contents may
+	// be shorter than a full page at the end of the bitvector.
+	load(off uint64) (uint64, []byte, error)
+
+	// markDirty records that the current page has been modified.
+	markDirty()
+
+	flush() error
+	close() error
+}
+
+func newPageCursor(ba BigBitVector) pageCursor {
+	switch x := ba.(type) {
+	case *inMemoryArray:
+		return &memCursor{bv: x}
+	case *onDiskArray:
+		return &diskCursor{bv: x}
+	case *atomicArray:
+		return &atomicCursor{bv: x}
+	default:
+		return &genericCursor{bv: ba}
+	}
+}
+
+// memCursor presents an in-memory bitvector as a single page.
+type memCursor struct {
+	bv *inMemoryArray
+}
+
+func (c *memCursor) load(off uint64) (uint64, []byte, error) {
+	return 0, c.bv.data, nil
+}
+
+func (c *memCursor) markDirty()   {}
+func (c *memCursor) flush() error { return nil }
+func (c *memCursor) close() error { return nil }
+
+// diskCursor keeps one page of an on-disk bitvector pinned in its cache.
+type diskCursor struct {
+	bv   *onDiskArray
+	page *cachePage
+}
+
+func (c *diskCursor) load(off uint64) (uint64, []byte, error) {
+	off = c.bv.pageOffset(off)
+	if c.page != nil && c.page.off == off {
+		return off, c.page.data, nil
+	}
+	if c.page != nil {
+		if err := flushPage(c.bv, c.page); err != nil {
+			return 0, nil, err
+		}
+		c.bv.disposePage(c.page)
+		c.page = nil
+	}
+	page, err := c.bv.acquirePage(off)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.page = page
+	return off, page.data, nil
+}
+
+func (c *diskCursor) markDirty() {
+	c.page.markDirty()
+}
+
+func (c *diskCursor) flush() error {
+	return flushPage(c.bv, c.page)
+}
+
+func (c *diskCursor) close() error {
+	err := flushPage(c.bv, c.page)
+	if err != nil {
+		// Leave the page dirty, for the next Flush or Close to retry.
+		c.bv.keepStuck(c.page)
+	} else {
+		c.bv.disposePage(c.page)
+	}
+	c.page = nil
+	return err
+}
+
+// genericCursor emulates pages for any other kind of bitvector, by reading
+// their bits through an Iterator and writing back only the bits that changed.
+type genericCursor struct {
+	bv    BigBitVector
+	buf   []byte
+	orig  []byte
+	base  uint64
+	valid bool
+	dirty bool
+}
+
+func (c *genericCursor) load(off uint64) (uint64, []byte, error) {
+	base := off - off%genericPageSize
+	if c.valid && c.base == base {
+		return base, c.buf, nil
+	}
+	if err := c.flush(); err != nil {
+		return 0, nil, err
+	}
+	c.valid = false
+
+	lo := base * 8
+	hi := lo + genericPageSize*8
+	if hi > c.bv.Len() {
+		hi = c.bv.Len()
+	}
+	n := (hi - lo + 7) / 8
+	if uint64(cap(c.buf)) < n {
+		c.buf = make([]byte, n)
+	}
+	c.buf = c.buf[0:n]
+	for i := range c.buf {
+		c.buf[i] = 0
+	}
+
+	iter := c.bv.Iterate(lo, hi)
+	for iter.Next() {
+		if iter.Bit() {
+			b, m := byteAndMask(iter.Index() - lo)
+			c.buf[b] |= m
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, nil, err
+	}
+
+	c.orig = append(c.orig[:0], c.buf...)
+	c.base = base
+	c.valid = true
+	c.dirty = false
+	return base, c.buf, nil
+}
+
+func (c *genericCursor) markDirty() {
+	c.dirty = true
+}
+
+func (c *genericCursor) flush() error {
+	if !c.valid || !c.dirty {
+		return nil
+	}
+	lo := c.base * 8
+	for b := range c.buf {
+		diff := c.buf[b] ^ c.orig[b]
+		for k := uint64(0); diff != 0; k++ {
+			m := byte(1) << k
+			if (diff & m) == 0 {
+				continue
+			}
+			diff &= ^m
+			index := lo + uint64(b)*8 + k
+			if index >= c.bv.Len() {
+				break
+			}
+			if err := c.bv.SetBitAt(index, (c.buf[b]&m) != 0); err != nil {
+				return err
+			}
+		}
+		c.orig[b] = c.buf[b]
+	}
+	c.dirty = false
+	return nil
+}
+
+func (c *genericCursor) close() error {
+	err := c.flush()
+	c.valid = false
+	return err
+}
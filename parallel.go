@@ -0,0 +1,193 @@
+package bigbitvector
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// partitionsPerWorker is the number of ranges handed out per worker, so that
+// workers which finish early can pick up the slack.
+const partitionsPerWorker = 4
+
+// Range is the half-open range of bit indices [Start, End).
+type Range struct {
+	Start uint64
+	End   uint64
+}
+
+// Len returns the number of bits in the range.
+func (r Range) Len() uint64 {
+	return r.End - r.Start
+}
+
+// MultiError collects the errors returned by several parallel workers.
+type MultiError []error
+
+func (errs MultiError) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors: %s", len(errs), strings.Join(msgs, "; "))
+}
+
+// partitionAlign returns the number of bits in the unit which ranges should
+// be aligned to, so that no two ranges share a page.
+func partitionAlign(ba BigBitVector) uint64 {
+	switch x := ba.(type) {
+	case *onDiskArray:
+		return uint64(x.psz) * 8
+	case *adaptiveArray:
+		return chunkBits
+	default:
+		return genericPageSize * 8
+	}
+}
+
+// isConcurrent returns true if iterators over disjoint pages of the bitvector
+// may be used from different goroutines at once.
+func isConcurrent(ba BigBitVector) bool {
+	switch ba.(type) {
+	case *inMemoryArray, *onDiskArray, *atomicArray:
+		return true
+	default:
+		return false
+	}
+}
+
+// Partition splits the bitvector into at most n contiguous ranges of roughly
+// equal size.  Every boundary between ranges falls on a page boundary, so
+// iterators over different ranges never share a page.
+func Partition(ba BigBitVector, n int) []Range {
+	if n < 1 {
+		panic(fmt.Errorf("Partition: n must be positive, got %d", n))
+	}
+	num := ba.Len()
+	if num == 0 {
+		return nil
+	}
+	align := partitionAlign(ba)
+	units := (num + align - 1) / align
+	per := (units + uint64(n) - 1) / uint64(n)
+
+	ranges := make([]Range, 0, n)
+	for start := uint64(0); start < num; start += per * align {
+		end := start + per*align
+		if end > num {
+			end = num
+		}
+		ranges = append(ranges, Range{Start: start, End: end})
+	}
+	return ranges
+}
+
+// ParallelRanges partitions the bitvector and calls fn from up to workers
+// goroutines at once, each time with an Iterator over one range and a context
+// which is cancelled once the work should stop.  fn may read and write bits
+// through the iterator; since ranges never share a page, the writers never
+// contend.  If workers is less than 1, GOMAXPROCS is used.  Bitvectors which
+// cannot be used from several goroutines at once are processed one range at
+// a time.
+//
+// Once fn returns an error, or the context is done, no new ranges are
+// started.  All errors are returned, as a MultiError if there is more than
+// one.
+//
+func ParallelRanges(ctx context.Context, ba BigBitVector, workers int, fn func(context.Context, Iterator) error) error {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if !isConcurrent(ba) {
+		workers = 1
+	}
+	ranges := Partition(ba, workers*partitionsPerWorker)
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var errs MultiError
+	report := func(err error) {
+		if err == ctx.Err() {
+			// Cancellation is reported once, below, if it came from
+			// the caller.
+			return
+		}
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+		cancel()
+	}
+
+	work := make(chan Range)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var iter Iterator
+			for r := range work {
+				if iter == nil {
+					iter = ba.Iterate(r.Start, r.End)
+				} else if err := iter.Reset(r.Start, r.End, false); err != nil {
+					report(err)
+					continue
+				}
+				err := fn(ctx, iter)
+				if err == nil {
+					err = iter.Err()
+				}
+				if err != nil {
+					report(err)
+				}
+			}
+			if iter != nil {
+				if err := iter.Close(); err != nil && err != ErrClosedIterator {
+					report(err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, r := range ranges {
+		select {
+		case work <- r:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err := parent.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return errs
+	}
+}
+
+// ParallelForEach calls fn for every bit of the bitvector, from up to workers
+// goroutines at once.  Bits within a range are visited in order, but ranges
+// are visited in no particular order.  See ParallelRanges for details.
+func ParallelForEach(ctx context.Context, ba BigBitVector, workers int, fn func(uint64, bool) error) error {
+	return ParallelRanges(ctx, ba, workers, func(ctx context.Context, iter Iterator) error {
+		iter = BindContext(ctx, iter)
+		for iter.Next() {
+			if err := fn(iter.Index(), iter.Bit()); err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	})
+}
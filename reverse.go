@@ -0,0 +1,86 @@
+package bigbitvector
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// byteReverse maps each byte to the byte with its bits in reverse order.
+var byteReverse = func() (t [256]byte) {
+	for i := range t {
+		t[i] = bits.Reverse8(uint8(i))
+	}
+	return t
+}()
+
+// reverseBits stores the first k bits of src into dst in reverse order, so
+// that bit t of dst is bit k-1-t of src.  Bits past k in src must be clear.
+func reverseBits(dst, src []byte, k uint64) {
+	nb := (k + 7) / 8
+	for t := uint64(0); t < nb; t++ {
+		dst[t] = byteReverse[src[nb-1-t]]
+	}
+	// Reversing whole bytes put the padding of the last byte first, so
+	// slide everything down over it.
+	s := uint(nb*8 - k)
+	if s == 0 {
+		return
+	}
+	for t := uint64(0); t < nb; t++ {
+		v := dst[t] >> s
+		if t+1 < nb {
+			v |= dst[t+1] << (8 - s)
+		}
+		dst[t] = v
+	}
+}
+
+// reverse reverses the order of the bits in [lo, hi), swapping a chunk from
+// each end at a time and working inward.
+func (m *bitMover) reverse(lo, hi uint64) error {
+	out := make([]byte, len(m.buf))
+	for hi-lo >= 2 {
+		k := (hi - lo) / 2
+		if k > m.chunk {
+			k = m.chunk
+		}
+		if err := ReadBits(m.ba, m.buf, lo, k); err != nil {
+			return err
+		}
+		if err := ReadBits(m.ba, m.tmp, hi-k, k); err != nil {
+			return err
+		}
+		reverseBits(out, m.tmp, k)
+		if err := WriteBits(m.ba, out, lo, k); err != nil {
+			return err
+		}
+		reverseBits(out, m.buf, k)
+		if err := WriteBits(m.ba, out, hi-k, k); err != nil {
+			return err
+		}
+		lo += k
+		hi -= k
+	}
+	return nil
+}
+
+// Reverse reverses the order of the bits of the bitvector in place, so that
+// bit i becomes bit Len()-1-i.  Pages are swapped from both ends inward, so
+// only a couple of pages are held in memory at once.
+func Reverse(ba BigBitVector) error {
+	return newBitMover(ba).reverse(0, ba.Len())
+}
+
+// ReverseRange reverses the order of the bits with indices i through j-1 in
+// place, so that bit i+k becomes bit j-1-k.  It returns io.EOF, and changes
+// nothing, if the range extends past the end of the bitvector.
+func ReverseRange(ba BigBitVector, i, j uint64) error {
+	if i > j {
+		panic(fmt.Errorf("ReverseRange: i > j: i=%d j=%d", i, j))
+	}
+	if j > ba.Len() {
+		return io.EOF
+	}
+	return newBitMover(ba).reverse(i, j)
+}
@@ -0,0 +1,93 @@
+package bigbitvector
+
+import (
+	"math/bits"
+)
+
+func checkSameLen(a, b BigBitVector) {
+	if a.Len() != b.Len() {
+		panic("bit arrays are not equal in size")
+	}
+}
+
+// anyWord returns true if fn is non-zero for some pair of words of a and b,
+// stopping at the first such pair.
+func anyWord(a, b BigBitVector, fn func(x, y uint64) uint64) (bool, error) {
+	checkSameLen(a, b)
+	found := false
+	err := streamWords(nil, []BigBitVector{a, b}, func(_, _ uint64, in []uint64) (uint64, error) {
+		if fn(in[0], in[1]) != 0 {
+			found = true
+			return 0, errStopStream
+		}
+		return 0, nil
+	})
+	return found, err
+}
+
+// countWords returns the total number of bits set in fn over all pairs of
+// words of a and b.
+func countWords(a, b BigBitVector, fn func(x, y uint64) uint64) (uint64, error) {
+	checkSameLen(a, b)
+	var total uint64
+	err := streamWords(nil, []BigBitVector{a, b}, func(_, _ uint64, in []uint64) (uint64, error) {
+		total += uint64(bits.OnesCount64(fn(in[0], in[1])))
+		return 0, nil
+	})
+	return total, err
+}
+
+// IsSubset returns true if every bit set in a is also set in b.  The
+// bitvectors must have the same length.  The scan stops at the first bit set
+// in a but not in b.
+func IsSubset(a, b BigBitVector) (bool, error) {
+	found, err := anyWord(a, b, func(x, y uint64) uint64 { return x & ^y })
+	return !found && err == nil, err
+}
+
+// Intersects returns true if some bit is set in both a and b.  The
+// bitvectors must have the same length.  The scan stops at the first such
+// bit.
+func Intersects(a, b BigBitVector) (bool, error) {
+	return anyWord(a, b, func(x, y uint64) uint64 { return x & y })
+}
+
+// Disjoint returns true if no bit is set in both a and b.  The bitvectors
+// must have the same length.
+func Disjoint(a, b BigBitVector) (bool, error) {
+	found, err := Intersects(a, b)
+	return !found && err == nil, err
+}
+
+// IntersectionCount returns the number of bits set in both a and b.  The
+// bitvectors must have the same length.
+func IntersectionCount(a, b BigBitVector) (uint64, error) {
+	return countWords(a, b, func(x, y uint64) uint64 { return x & y })
+}
+
+// UnionCount returns the number of bits set in either a or b.  The
+// bitvectors must have the same length.
+func UnionCount(a, b BigBitVector) (uint64, error) {
+	return countWords(a, b, func(x, y uint64) uint64 { return x | y })
+}
+
+// Jaccard returns the Jaccard similarity of a and b: the size of their
+// intersection divided by the size of their union, counted in a single pass.
+// Two empty bitvectors are identical, with a similarity of 1.  The
+// bitvectors must have the same length.
+func Jaccard(a, b BigBitVector) (float64, error) {
+	checkSameLen(a, b)
+	var inter, union uint64
+	err := streamWords(nil, []BigBitVector{a, b}, func(_, _ uint64, in []uint64) (uint64, error) {
+		inter += uint64(bits.OnesCount64(in[0] & in[1]))
+		union += uint64(bits.OnesCount64(in[0] | in[1]))
+		return 0, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if union == 0 {
+		return 1, nil
+	}
+	return float64(inter) / float64(union), nil
+}
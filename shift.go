@@ -0,0 +1,206 @@
+package bigbitvector
+
+// bitMover moves runs of bits around within one bitvector, a chunk at a time,
+// so that it never holds more than a couple of pages in memory.
+type bitMover struct {
+	ba    BigBitVector
+	chunk uint64
+	buf   []byte
+	tmp   []byte
+}
+
+func newBitMover(ba BigBitVector) *bitMover {
+	if ba.Frozen() {
+		panic("BigBitVector is read-only")
+	}
+	chunk := partitionAlign(ba)
+	return &bitMover{
+		ba:    ba,
+		chunk: chunk,
+		buf:   make([]byte, chunk/8),
+		tmp:   make([]byte, chunk/8),
+	}
+}
+
+// copy copies the n bits starting at src to dst.  The ranges may overlap;
+// like memmove, it works from whichever end keeps the unread source intact.
+func (m *bitMover) copy(dst, src, n uint64) error {
+	if dst == src {
+		return nil
+	}
+	for done := uint64(0); done < n; {
+		k := n - done
+		if k > m.chunk {
+			k = m.chunk
+		}
+		off := done
+		if dst > src {
+			off = n - done - k
+		}
+		if err := ReadBits(m.ba, m.buf, src+off, k); err != nil {
+			return err
+		}
+		if err := WriteBits(m.ba, m.buf, dst+off, k); err != nil {
+			return err
+		}
+		done += k
+	}
+	return nil
+}
+
+// clear clears the n bits starting at lo.
+func (m *bitMover) clear(lo, n uint64) error {
+	for i := range m.buf {
+		m.buf[i] = 0
+	}
+	for n > 0 {
+		k := n
+		if k > m.chunk {
+			k = m.chunk
+		}
+		if err := WriteBits(m.ba, m.buf, lo, k); err != nil {
+			return err
+		}
+		lo += k
+		n -= k
+	}
+	return nil
+}
+
+// swap exchanges the n bits starting at x with the n bits starting at y.
+// The ranges must not overlap.
+func (m *bitMover) swap(x, y, n uint64) error {
+	for n > 0 {
+		k := n
+		if k > m.chunk {
+			k = m.chunk
+		}
+		if err := ReadBits(m.ba, m.buf, x, k); err != nil {
+			return err
+		}
+		if err := ReadBits(m.ba, m.tmp, y, k); err != nil {
+			return err
+		}
+		if err := WriteBits(m.ba, m.tmp, x, k); err != nil {
+			return err
+		}
+		if err := WriteBits(m.ba, m.buf, y, k); err != nil {
+			return err
+		}
+		x += k
+		y += k
+		n -= k
+	}
+	return nil
+}
+
+// rotate rotates the bits in [lo, hi) by d places toward lo.
+//
+// While both parts of the range are longer than a chunk, it swaps the
+// shorter part into its final place, as in the Gries-Mills block swap
+// algorithm, which leaves a smaller rotation to do.  Once either part fits
+// in a chunk, that part is set aside and the other part is copied over.
+func (m *bitMover) rotate(lo, hi, d uint64) error {
+	for {
+		n := hi - lo
+		switch {
+		case d == 0 || d == n:
+			return nil
+
+		case d <= m.chunk:
+			save := make([]byte, (d+7)/8)
+			if err := ReadBits(m.ba, save, lo, d); err != nil {
+				return err
+			}
+			if err := m.copy(lo, lo+d, n-d); err != nil {
+				return err
+			}
+			return WriteBits(m.ba, save, hi-d, d)
+
+		case n-d <= m.chunk:
+			r := n - d
+			save := make([]byte, (r+7)/8)
+			if err := ReadBits(m.ba, save, hi-r, r); err != nil {
+				return err
+			}
+			if err := m.copy(lo+r, lo, d); err != nil {
+				return err
+			}
+			return WriteBits(m.ba, save, lo, r)
+
+		case d < n-d:
+			// A B1 B2 => B2 B1 A, leaving B2 B1 to rotate by d.
+			if err := m.swap(lo, hi-d, d); err != nil {
+				return err
+			}
+			hi -= d
+
+		case d > n-d:
+			// A1 A2 B => B A2 A1, leaving A2 A1 to rotate by d-|B|.
+			r := n - d
+			if err := m.swap(lo, lo+d, r); err != nil {
+				return err
+			}
+			lo += r
+			d -= r
+
+		default:
+			return m.swap(lo, lo+d, d)
+		}
+	}
+}
+
+// ShiftLeft moves every bit of the bitvector n places toward index 0, as
+// shown by Debug: bit i+n becomes bit i.  The last n bits are cleared.
+//
+// The bits are moved in place, a page at a time and starting from index 0, so
+// that each page is read before it is overwritten and only a couple of pages
+// are held in memory at once.
+//
+func ShiftLeft(ba BigBitVector, n uint64) error {
+	m := newBitMover(ba)
+	num := ba.Len()
+	if n >= num {
+		return m.clear(0, num)
+	}
+	if err := m.copy(0, n, num-n); err != nil {
+		return err
+	}
+	return m.clear(num-n, n)
+}
+
+// ShiftRight moves every bit of the bitvector n places away from index 0:
+// bit i becomes bit i+n.  The first n bits are cleared.  Like ShiftLeft, it
+// works in place, starting from the end of the bitvector.
+func ShiftRight(ba BigBitVector, n uint64) error {
+	m := newBitMover(ba)
+	num := ba.Len()
+	if n >= num {
+		return m.clear(0, num)
+	}
+	if err := m.copy(n, 0, num-n); err != nil {
+		return err
+	}
+	return m.clear(0, n)
+}
+
+// Rotate rotates the bits of the bitvector n places toward index 0, like
+// ShiftLeft except that the bits shifted out of the start of the bitvector
+// reappear at its end.  A negative n rotates the other way, like ShiftRight.
+//
+// The rotation is done in place, holding only a few pages in memory at once.
+//
+func Rotate(ba BigBitVector, n int64) error {
+	m := newBitMover(ba)
+	num := ba.Len()
+	if num == 0 {
+		return nil
+	}
+	var d uint64
+	if n >= 0 {
+		d = uint64(n) % num
+	} else {
+		d = num - uint64(-n)%num
+	}
+	return m.rotate(0, num, d%num)
+}
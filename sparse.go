@@ -0,0 +1,572 @@
+package bigbitvector
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	sparseLeafMax       = 512
+	sparseLeafOverhead  = 64
+	sparseDensityCutoff = 1.0 / 64
+)
+
+var errCorruptLeaf = errors.New("spilled leaf is corrupt")
+
+// sparseLeaf holds a sorted run of set positions.  Leaves partition the
+// index space: leaf i holds the positions in [leaves[i].min, leaves[i+1].min).
+// Non-resident leaves have been spilled to disk and have nil keys.
+type sparseLeaf struct {
+	keys     []uint64
+	min      uint64
+	id       uint64
+	stamp    uint64
+	sz       uint64
+	n        int
+	resident bool
+	dirty    bool
+}
+
+// sparseArray stores the positions of the set bits in a two-level B+tree: an
+// in-memory index of leaves, each holding up to sparseLeafMax positions.
+// Leaves are spilled to a private temporary file, least recently used
+// first, once resident leaves use more than the configured limit.
+type sparseArray struct {
+	leaves []*sparseLeaf
+	spill  spillStore
+	buf    []byte
+	nextID uint64
+	mem    uint64
+	limit  uint64
+	clock  uint64
+	mods   uint64
+	num    uint64
+	ro     bool
+}
+
+func newSparseArray(num, limit uint64, ro bool) *sparseArray {
+	return &sparseArray{
+		spill: newSpillStore(),
+		limit: limit,
+		num:   num,
+		ro:    ro,
+	}
+}
+
+func (bv *sparseArray) Frozen() bool {
+	return bv.ro
+}
+
+func (bv *sparseArray) Len() uint64 {
+	return bv.num
+}
+
+func (bv *sparseArray) BitAt(index uint64) (bool, error) {
+	if index >= bv.Len() {
+		return false, io.EOF
+	}
+	next, found, err := bv.ceil(index)
+	return found && next == index, err
+}
+
+func (bv *sparseArray) SetBitAt(index uint64, bit bool) error {
+	if bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if index >= bv.Len() {
+		return io.EOF
+	}
+	if bit {
+		return bv.set(index)
+	}
+	return bv.clear(index)
+}
+
+func (bv *sparseArray) Iterate(i, j uint64) Iterator {
+	if i > j {
+		panic(fmt.Errorf("sparseArray.Iterate: i > j: i=%d j=%d", i, j))
+	}
+	return &sparseIterator{
+		bv:   bv,
+		base: i,
+		num:  (j - i),
+	}
+}
+
+func (bv *sparseArray) ReverseIterate(i, j uint64) Iterator {
+	if i > j {
+		panic(fmt.Errorf("sparseArray.ReverseIterate: i > j: i=%d j=%d", i, j))
+	}
+	return &sparseIterator{
+		bv:   bv,
+		base: i,
+		num:  (j - i),
+		down: true,
+	}
+}
+
+func (bv *sparseArray) CopyFrom(src BigBitVector) error {
+	if bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if src.Len() != bv.Len() {
+		panic("bit arrays are not equal in size")
+	}
+	return copyFromImpl(bv, src)
+}
+
+func (bv *sparseArray) Truncate(n uint64) error {
+	if bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if n > bv.Len() {
+		panic("cannot grow a bit array")
+	}
+
+	i := bv.find(n)
+	if i >= 0 {
+		leaf := bv.leaves[i]
+		if err := bv.load(leaf); err != nil {
+			return err
+		}
+		j := sort.Search(leaf.n, func(j int) bool { return leaf.keys[j] >= n })
+		if j != leaf.n {
+			leaf.keys = leaf.keys[:j]
+			leaf.n = j
+			leaf.dirty = true
+			bv.resize(leaf)
+		}
+		for _, x := range bv.leaves[i+1:] {
+			bv.discard(x)
+		}
+		bv.leaves = bv.leaves[:i+1]
+		if leaf.n == 0 {
+			bv.remove(i)
+		}
+	}
+	bv.mods++
+	bv.num = n
+	return nil
+}
+
+func (bv *sparseArray) Freeze() error {
+	bv.ro = true
+	return nil
+}
+
+func (bv *sparseArray) Flush() error {
+	return nil
+}
+
+func (bv *sparseArray) Close() error {
+	bv.leaves = nil
+	bv.mem = 0
+	return bv.spill.close()
+}
+
+func (bv *sparseArray) Debug() string {
+	return debugImpl(bv)
+}
+
+func (bv *sparseArray) count() (uint64, error) {
+	var total uint64
+	for _, leaf := range bv.leaves {
+		total += uint64(leaf.n)
+	}
+	return total, nil
+}
+
+// find returns the index of the leaf that holds (or would hold) position k,
+// or -1 if there are no leaves.
+func (bv *sparseArray) find(k uint64) int {
+	i := sort.Search(len(bv.leaves), func(i int) bool { return bv.leaves[i].min > k })
+	if i == 0 && len(bv.leaves) == 0 {
+		return -1
+	}
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// ceil returns the smallest set position >= k.
+func (bv *sparseArray) ceil(k uint64) (uint64, bool, error) {
+	i := bv.find(k)
+	if i < 0 {
+		return 0, false, nil
+	}
+	for ; i < len(bv.leaves); i++ {
+		leaf := bv.leaves[i]
+		if err := bv.load(leaf); err != nil {
+			return 0, false, err
+		}
+		j := sort.Search(leaf.n, func(j int) bool { return leaf.keys[j] >= k })
+		if j < leaf.n {
+			return leaf.keys[j], true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// floor returns the largest set position <= k.
+func (bv *sparseArray) floor(k uint64) (uint64, bool, error) {
+	i := bv.find(k)
+	for ; i >= 0; i-- {
+		leaf := bv.leaves[i]
+		if err := bv.load(leaf); err != nil {
+			return 0, false, err
+		}
+		j := sort.Search(leaf.n, func(j int) bool { return leaf.keys[j] > k })
+		if j > 0 {
+			return leaf.keys[j-1], true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (bv *sparseArray) set(k uint64) error {
+	i := bv.find(k)
+	if i < 0 {
+		if err := bv.evict(nil); err != nil {
+			return err
+		}
+		bv.mods++
+		leaf := bv.newLeaf([]uint64{k})
+		bv.leaves = append(bv.leaves, leaf)
+		return nil
+	}
+
+	leaf := bv.leaves[i]
+	if err := bv.load(leaf); err != nil {
+		return err
+	}
+	j := sort.Search(leaf.n, func(j int) bool { return leaf.keys[j] >= k })
+	if j < leaf.n && leaf.keys[j] == k {
+		return nil
+	}
+	bv.mods++
+	leaf.keys = append(leaf.keys, 0)
+	copy(leaf.keys[j+1:], leaf.keys[j:])
+	leaf.keys[j] = k
+	leaf.n++
+	leaf.dirty = true
+	if k < leaf.min {
+		leaf.min = k
+	}
+
+	if leaf.n > sparseLeafMax {
+		half := leaf.n / 2
+		upper := make([]uint64, leaf.n-half, sparseLeafMax)
+		copy(upper, leaf.keys[half:])
+		leaf.keys = leaf.keys[:half]
+		leaf.n = half
+
+		right := bv.newLeaf(upper)
+		bv.leaves = append(bv.leaves, nil)
+		copy(bv.leaves[i+2:], bv.leaves[i+1:])
+		bv.leaves[i+1] = right
+	}
+	bv.resize(leaf)
+	return bv.evict(leaf)
+}
+
+func (bv *sparseArray) clear(k uint64) error {
+	i := bv.find(k)
+	if i < 0 {
+		return nil
+	}
+	leaf := bv.leaves[i]
+	if err := bv.load(leaf); err != nil {
+		return err
+	}
+	j := sort.Search(leaf.n, func(j int) bool { return leaf.keys[j] >= k })
+	if j >= leaf.n || leaf.keys[j] != k {
+		return nil
+	}
+	bv.mods++
+	leaf.keys = append(leaf.keys[:j], leaf.keys[j+1:]...)
+	leaf.n--
+	leaf.dirty = true
+	bv.resize(leaf)
+	if leaf.n == 0 {
+		bv.remove(i)
+	}
+	return nil
+}
+
+func (bv *sparseArray) newLeaf(keys []uint64) *sparseLeaf {
+	bv.clock++
+	leaf := &sparseLeaf{
+		keys:     keys,
+		min:      keys[0],
+		id:       bv.nextID,
+		stamp:    bv.clock,
+		n:        len(keys),
+		resident: true,
+		dirty:    true,
+	}
+	bv.nextID++
+	bv.resize(leaf)
+	return leaf
+}
+
+func (bv *sparseArray) remove(i int) {
+	bv.discard(bv.leaves[i])
+	bv.leaves = append(bv.leaves[:i], bv.leaves[i+1:]...)
+}
+
+func (bv *sparseArray) discard(leaf *sparseLeaf) {
+	bv.spill.remove(leaf.id)
+	bv.mem -= leaf.sz
+	leaf.sz = 0
+}
+
+func (bv *sparseArray) resize(leaf *sparseLeaf) {
+	var sz uint64
+	if leaf.resident {
+		sz = sparseLeafOverhead + 8*uint64(cap(leaf.keys))
+	}
+	bv.mem += sz - leaf.sz
+	leaf.sz = sz
+}
+
+func (bv *sparseArray) load(leaf *sparseLeaf) error {
+	bv.clock++
+	leaf.stamp = bv.clock
+	if leaf.resident {
+		return nil
+	}
+	if err := bv.evict(nil); err != nil {
+		return err
+	}
+
+	data, found, err := bv.spill.load(leaf.id, bv.buf)
+	bv.buf = data
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errCorruptLeaf
+	}
+	keys, err := decodeKeys(data, leaf.n)
+	if err != nil {
+		return err
+	}
+	leaf.keys = keys
+	leaf.resident = true
+	leaf.dirty = false
+	bv.resize(leaf)
+	return nil
+}
+
+// evict spills the least recently used leaves to disk once resident leaves
+// use more than the configured limit.  The pinned leaf, if any, is kept.
+func (bv *sparseArray) evict(pin *sparseLeaf) error {
+	if bv.mem <= bv.limit {
+		return nil
+	}
+
+	victims := make([]*sparseLeaf, 0, len(bv.leaves))
+	for _, leaf := range bv.leaves {
+		if leaf.resident && leaf != pin {
+			victims = append(victims, leaf)
+		}
+	}
+	sort.Slice(victims, func(i, j int) bool { return victims[i].stamp < victims[j].stamp })
+
+	target := bv.limit - bv.limit/4
+	for _, leaf := range victims {
+		if bv.mem <= target {
+			break
+		}
+		if leaf.dirty || !bv.spill.has(leaf.id) {
+			bv.buf = encodeKeys(bv.buf[:0], leaf.keys)
+			if err := bv.spill.store(leaf.id, bv.buf); err != nil {
+				return err
+			}
+		}
+		leaf.keys = nil
+		leaf.resident = false
+		leaf.dirty = false
+		bv.resize(leaf)
+	}
+	return nil
+}
+
+var _ BigBitVector = (*sparseArray)(nil)
+
+// encodeKeys appends the delta-coded uvarint encoding of keys to dst.
+func encodeKeys(dst []byte, keys []uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	var prev uint64
+	for _, k := range keys {
+		n := binary.PutUvarint(tmp[:], k-prev)
+		dst = append(dst, tmp[:n]...)
+		prev = k
+	}
+	return dst
+}
+
+func decodeKeys(data []byte, n int) ([]uint64, error) {
+	keys := make([]uint64, n, sparseLeafMax)
+	var prev uint64
+	for i := range keys {
+		delta, k := binary.Uvarint(data)
+		if k <= 0 {
+			return nil, errCorruptLeaf
+		}
+		data = data[k:]
+		prev += delta
+		keys[i] = prev
+	}
+	if len(data) != 0 {
+		return nil, errCorruptLeaf
+	}
+	return keys, nil
+}
+
+type sparseIterator struct {
+	bv     *sparseArray
+	err    error
+	base   uint64
+	pos    uint64
+	num    uint64
+	next   uint64
+	mods   uint64
+	val    bool
+	primed bool
+	down   bool
+	cached bool
+	found  bool
+}
+
+func (iter *sparseIterator) Err() error { return iter.err }
+func (iter *sparseIterator) Next() bool { return iter.Skip(1) }
+
+func (iter *sparseIterator) Index() uint64 {
+	if !iter.primed {
+		panic("must call Next() before Index()")
+	}
+	if iter.pos >= iter.num {
+		panic("must not call Index() after Next() returns false")
+	}
+	if iter.down {
+		return iter.base + (iter.num - iter.pos - 1)
+	}
+	return iter.base + iter.pos
+}
+
+func (iter *sparseIterator) Bit() bool {
+	if !iter.primed {
+		panic("must call Next() before Bit()")
+	}
+	if iter.pos >= iter.num {
+		panic("must not call Bit() after Next() returns false")
+	}
+	return iter.val
+}
+
+func (iter *sparseIterator) SetBit(bit bool) {
+	if !iter.primed {
+		panic("must call Next() before SetBit()")
+	}
+	if iter.pos >= iter.num {
+		panic("must not call SetBit() after Next() returns false")
+	}
+	if iter.err != nil {
+		return
+	}
+	if iter.bv.ro {
+		panic("BigBitVector is read-only")
+	}
+	if iter.val == bit {
+		return
+	}
+	var err error
+	if bit {
+		err = iter.bv.set(iter.Index())
+	} else {
+		err = iter.bv.clear(iter.Index())
+	}
+	if err != nil {
+		iter.err = err
+		return
+	}
+	iter.val = bit
+	iter.cached = false
+}
+
+func (iter *sparseIterator) Skip(n uint64) bool {
+	if iter.pos > iter.num {
+		panic(fmt.Sprintf("iter.pos=%d iter.num=%d", iter.pos, iter.num))
+	}
+	if n == 0 && !iter.primed {
+		panic("must call Next() before Skip(0)")
+	}
+	if iter.err != nil {
+		return false
+	}
+	if !iter.primed {
+		n--
+		iter.primed = true
+	}
+	if n >= (iter.num - iter.pos) {
+		iter.pos = iter.num
+		iter.val = false
+		return false
+	}
+	iter.pos += n
+
+	// iter.next caches the nearest set position at or beyond the current
+	// index, in the direction of iteration, until the bitvector changes.
+	index := iter.Index()
+	stale := !iter.cached || iter.mods != iter.bv.mods
+	if !stale && iter.found {
+		stale = (!iter.down && index > iter.next) || (iter.down && index < iter.next)
+	}
+	if stale {
+		var err error
+		if iter.down {
+			iter.next, iter.found, err = iter.bv.floor(index)
+		} else {
+			iter.next, iter.found, err = iter.bv.ceil(index)
+		}
+		if err != nil {
+			iter.err = err
+			iter.val = false
+			return false
+		}
+		iter.cached = true
+		iter.mods = iter.bv.mods
+	}
+	iter.val = iter.found && iter.next == index
+	return true
+}
+
+func (iter *sparseIterator) Flush() error {
+	return nil
+}
+
+func (iter *sparseIterator) Close() error {
+	err := iter.err
+	*iter = sparseIterator{bv: iter.bv, err: ErrClosedIterator}
+	return err
+}
+
+func (iter *sparseIterator) Reset(i, j uint64, reverse bool) error {
+	if i > j {
+		panic(fmt.Errorf("sparseIterator.Reset: i > j: i=%d j=%d", i, j))
+	}
+	*iter = sparseIterator{
+		bv:   iter.bv,
+		base: i,
+		num:  (j - i),
+		down: reverse,
+	}
+	return nil
+}
+
+var _ Iterator = (*sparseIterator)(nil)
@@ -0,0 +1,76 @@
+package bigbitvector
+
+import (
+	"io/ioutil"
+)
+
+// spillStore holds variable-length blobs, keyed by number, in a private
+// temporary file.  The file is created on first use.
+type spillStore struct {
+	f     File
+	alloc extentAllocator
+	index map[uint64]extent
+}
+
+func newSpillStore() spillStore {
+	return spillStore{
+		alloc: newExtentAllocator(0),
+		index: make(map[uint64]extent),
+	}
+}
+
+func (s *spillStore) has(key uint64) bool {
+	_, found := s.index[key]
+	return found
+}
+
+// load reads the blob stored under key into buf, growing it if necessary.
+func (s *spillStore) load(key uint64, buf []byte) ([]byte, bool, error) {
+	x, found := s.index[key]
+	if !found {
+		return buf[:0], false, nil
+	}
+	if uint64(cap(buf)) < x.len {
+		buf = make([]byte, x.len)
+	}
+	buf = buf[0:x.len]
+	if _, err := s.f.ReadAt(buf, int64(x.off)); err != nil {
+		return buf[:0], false, err
+	}
+	return buf, true, nil
+}
+
+func (s *spillStore) store(key uint64, data []byte) error {
+	if s.f == nil {
+		f, err := ioutil.TempFile("", "tmp")
+		if err != nil {
+			return err
+		}
+		s.f = f
+	}
+
+	x := s.alloc.alloc(uint64(len(data)))
+	if _, err := s.f.WriteAt(data, int64(x.off)); err != nil {
+		s.alloc.release(x)
+		return err
+	}
+	s.remove(key)
+	s.index[key] = x
+	return nil
+}
+
+func (s *spillStore) remove(key uint64) {
+	if x, found := s.index[key]; found {
+		delete(s.index, key)
+		s.alloc.release(x)
+	}
+}
+
+func (s *spillStore) close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := removeFile(s.f)
+	*s = spillStore{}
+	return err
+}
@@ -0,0 +1,137 @@
+package bigbitvector
+
+import (
+	"io"
+	"math/bits"
+)
+
+// bitSlicedCounter counts, for each of the 64 bit positions of a word, how
+// many of the words added to it had that bit set.  Bit j of the count for
+// position i is bit i of planes[j].
+type bitSlicedCounter struct {
+	planes []uint64
+}
+
+func newBitSlicedCounter(max int) *bitSlicedCounter {
+	return &bitSlicedCounter{planes: make([]uint64, bits.Len(uint(max)))}
+}
+
+func (c *bitSlicedCounter) reset() {
+	for j := range c.planes {
+		c.planes[j] = 0
+	}
+}
+
+// add increments the counts of the positions set in word, rippling the
+// carries through the planes like a bank of parallel adders.
+func (c *bitSlicedCounter) add(word uint64) {
+	carry := word
+	for j := 0; carry != 0 && j < len(c.planes); j++ {
+		c.planes[j], carry = c.planes[j]^carry, c.planes[j]&carry
+	}
+}
+
+// atLeast returns the positions whose counts are at least k.
+func (c *bitSlicedCounter) atLeast(k uint) uint64 {
+	if bits.Len(k) > len(c.planes) {
+		return 0
+	}
+	var gt uint64
+	eq := ^uint64(0)
+	for j := len(c.planes) - 1; j >= 0; j-- {
+		if (k>>uint(j))&1 != 0 {
+			eq &= c.planes[j]
+		} else {
+			gt |= eq & c.planes[j]
+			eq &= ^c.planes[j]
+		}
+	}
+	return gt | eq
+}
+
+// pack stores the counts of the 64 positions into b, width bits apiece,
+// using the same layout as the bits of a bitvector.
+func (c *bitSlicedCounter) pack(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	width := uint(len(c.planes))
+	for j, plane := range c.planes {
+		for plane != 0 {
+			i := uint(bits.TrailingZeros64(plane))
+			pos := i*width + uint(j)
+			b[pos/8] |= byte(1) << (pos % 8)
+			plane &= plane - 1
+		}
+	}
+}
+
+func checkSources(name string, srcs []BigBitVector) {
+	if len(srcs) == 0 {
+		panic(name + " requires at least one source")
+	}
+	for _, src := range srcs[1:] {
+		if src.Len() != srcs[0].Len() {
+			panic("bit arrays are not equal in size")
+		}
+	}
+}
+
+// Threshold sets each bit of dst which is set in at least k of the sources,
+// and clears the rest.  The sources are streamed together, page by page, and
+// tallied with bit-sliced counters 64 positions at a time, so the cost grows
+// with the number of sources but no intermediate bitvectors are needed.  dst
+// must have the same length as the sources, and may be one of them.
+//
+// Threshold with k == 1 computes the union of the sources, and with k ==
+// len(srcs) their intersection.
+//
+func Threshold(dst BigBitVector, k uint, srcs ...BigBitVector) error {
+	if dst.Frozen() {
+		panic("BigBitVector is read-only")
+	}
+	checkSources("Threshold", srcs)
+	if dst.Len() != srcs[0].Len() {
+		panic("bit arrays are not equal in size")
+	}
+	c := newBitSlicedCounter(len(srcs))
+	return streamWords(dst, srcs, func(_, mask uint64, in []uint64) (uint64, error) {
+		c.reset()
+		for _, word := range in {
+			c.add(word)
+		}
+		return c.atLeast(k) & mask, nil
+	})
+}
+
+// Counts writes, for every bit position, the number of sources in which that
+// bit is set.  The counts are packed into dst as unsigned integers of the
+// returned width in bits, which is just enough to hold len(srcs): the count
+// for position i occupies bits i*width through i*width+width-1, with bit b at
+// bit (b%8) of byte (b/8), like the bits of a bitvector.  The final byte is
+// padded with zeroes.
+//
+// To keep the counts in a bitvector, pass AsFile of a bitvector with
+// width*Len() bits.
+//
+func Counts(dst io.WriterAt, srcs ...BigBitVector) (width uint, err error) {
+	checkSources("Counts", srcs)
+	c := newBitSlicedCounter(len(srcs))
+	width = uint(len(c.planes))
+	num := srcs[0].Len()
+	buf := make([]byte, 8*width)
+	err = streamWords(nil, srcs, func(index, _ uint64, in []uint64) (uint64, error) {
+		c.reset()
+		for _, word := range in {
+			c.add(word)
+		}
+		c.pack(buf)
+		n := uint64(len(buf))
+		if end := num - index; end < 64 {
+			n = (end*uint64(width) + 7) / 8
+		}
+		_, err := dst.WriteAt(buf[0:n], int64(index/8*uint64(width)))
+		return 0, err
+	})
+	return width, err
+}
@@ -0,0 +1,158 @@
+package bigbitvector
+
+import (
+	"sync/atomic"
+)
+
+// uniformMap tracks which pages are known to consist entirely of 0x00 bytes or
+// entirely of 0xff bytes, using two bits per page.  Pages that are known to be
+// uniform can be produced without touching the disk.
+//
+// Iterators over disjoint pages may run in parallel, so the bits of different
+// pages which share a word are updated atomically.
+type uniformMap struct {
+	known []uint64
+	ones  []uint64
+}
+
+func newUniformMap(numPages uint64) uniformMap {
+	numWords := (numPages + 63) / 64
+	return uniformMap{
+		known: make([]uint64, numWords),
+		ones:  make([]uint64, numWords),
+	}
+}
+
+func (u *uniformMap) get(idx uint64) (known bool, ones bool) {
+	w, m := idx/64, uint64(1)<<(idx%64)
+	if w >= uint64(len(u.known)) {
+		return false, false
+	}
+	known = (atomic.LoadUint64(&u.known[w]) & m) != 0
+	ones = (atomic.LoadUint64(&u.ones[w]) & m) != 0
+	return known, ones
+}
+
+func (u *uniformMap) mark(idx uint64, ones bool) {
+	w, m := idx/64, uint64(1)<<(idx%64)
+	if w >= uint64(len(u.known)) {
+		return
+	}
+	if known, wasOnes := u.get(idx); known && wasOnes == ones {
+		return
+	}
+	clearBits(&u.known[w], m)
+	if ones {
+		setBits(&u.ones[w], m)
+	} else {
+		clearBits(&u.ones[w], m)
+	}
+	setBits(&u.known[w], m)
+}
+
+func (u *uniformMap) forget(idx uint64) {
+	w, m := idx/64, uint64(1)<<(idx%64)
+	if w >= uint64(len(u.known)) {
+		return
+	}
+	clearBits(&u.known[w], m)
+}
+
+func setBits(addr *uint64, m uint64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if (old&m) == m || atomic.CompareAndSwapUint64(addr, old, old|m) {
+			return
+		}
+	}
+}
+
+func clearBits(addr *uint64, m uint64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if (old&m) == 0 || atomic.CompareAndSwapUint64(addr, old, old&^m) {
+			return
+		}
+	}
+}
+
+// classify records whether or not data, the contents of page idx, is uniform.
+// It returns true if the page is entirely zero.
+func (u *uniformMap) classify(idx uint64, data []byte) bool {
+	if len(data) == 0 || (data[0] != 0x00 && data[0] != 0xff) {
+		u.forget(idx)
+		return false
+	}
+	for _, b := range data[1:] {
+		if b != data[0] {
+			u.forget(idx)
+			return false
+		}
+	}
+	u.mark(idx, data[0] == 0xff)
+	return data[0] == 0x00
+}
+
+func (u *uniformMap) markAllZero() {
+	for i := range u.known {
+		u.known[i] = ^uint64(0)
+		u.ones[i] = 0
+	}
+}
+
+func (u *uniformMap) truncate(numPages uint64) {
+	numWords := (numPages + 63) / 64
+	if numWords > uint64(len(u.known)) {
+		// An empty map, as used for page-locked files, tracks nothing.
+		return
+	}
+	u.known = u.known[0:numWords]
+	u.ones = u.ones[0:numWords]
+	if r := numPages % 64; r != 0 {
+		mask := (uint64(1) << r) - 1
+		u.known[numWords-1] &= mask
+		u.ones[numWords-1] &= mask
+	}
+}
+
+// markZeroRange marks every page lying entirely within the byte range
+// [lo, hi) as all-zero.
+func (bv *onDiskArray) markZeroRange(lo, hi uint64) {
+	psz := uint64(bv.psz)
+	numBytes := (bv.num + 7) / 8
+	if hi > numBytes {
+		hi = numBytes
+	}
+	for idx := (lo + psz - 1) / psz; idx*psz < hi; idx++ {
+		end := (idx + 1) * psz
+		if end > numBytes {
+			end = numBytes
+		}
+		if end > hi {
+			break
+		}
+		bv.uni.mark(idx, false)
+	}
+}
+
+// fillUniform fills b with the contents of page off, if the page is known to
+// be uniform.  It returns the length of the page and true on success.
+func (bv *onDiskArray) fillUniform(off uint64, b []byte) (int, bool) {
+	known, ones := bv.uni.get(off / uint64(bv.psz))
+	if !known {
+		return 0, false
+	}
+	numBytes := (bv.num + 7) / 8
+	n := uint64(len(b))
+	if off+n > numBytes {
+		n = numBytes - off
+	}
+	fill := byte(0x00)
+	if ones {
+		fill = 0xff
+	}
+	for i := uint64(0); i < n; i++ {
+		b[i] = fill
+	}
+	return int(n), true
+}
@@ -0,0 +1,64 @@
+package bigbitvector
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+)
+
+func rawOSFile(file File) *os.File {
+	if w, ok := file.(wrappedReaderAt); ok {
+		f, _ := w.r.(*os.File)
+		return f
+	}
+	f, _ := file.(*os.File)
+	return f
+}
+
+// punchHole deallocates the byte range [off, off+n) of file, which will read
+// back as zeroes.  It returns false if the file does not support it.
+func punchHole(file File, off, n uint64) bool {
+	f := rawOSFile(file)
+	if f == nil {
+		return false
+	}
+	err := syscall.Fallocate(
+		int(f.Fd()),
+		fallocPunchHole|fallocKeepSize,
+		int64(off),
+		int64(n))
+	return err == nil
+}
+
+// scanHoles calls fn for each hole within the first size bytes of file.
+func scanHoles(file File, size uint64, fn func(lo, hi uint64)) {
+	f := rawOSFile(file)
+	if f == nil {
+		return
+	}
+	pos := uint64(0)
+	for pos < size {
+		data, err := f.Seek(int64(pos), seekData)
+		if err != nil {
+			if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+				fn(pos, size)
+			}
+			return
+		}
+		if uint64(data) > pos {
+			fn(pos, uint64(data))
+		}
+		hole, err := f.Seek(data, seekHole)
+		if err != nil {
+			return
+		}
+		pos = uint64(hole)
+	}
+}
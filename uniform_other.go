@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package bigbitvector
+
+func punchHole(file File, off, n uint64) bool {
+	return false
+}
+
+func scanHoles(file File, size uint64, fn func(lo, hi uint64)) {
+}
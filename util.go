@@ -22,6 +22,13 @@ func removeFile(file File) error {
 	return file.Close()
 }
 
+func closeFile(file File, remove bool) error {
+	if remove {
+		return removeFile(file)
+	}
+	return file.Close()
+}
+
 func debugImpl(ba BigBitVector) string {
 	var buf bytes.Buffer
 	buf.WriteByte('[')
@@ -0,0 +1,334 @@
+package bigbitvector
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// WordIterator provides access to a BigBitVector 64 bits at a time.
+//
+// Words are aligned to multiples of 64 bits within the bitvector, and bit k of
+// a word is the bit with index Index()+k.  The first and last words of the
+// range may be partial; Mask reports which bits of the current word lie
+// inside the range, and bits outside the mask always read as zero.
+//
+// The basic usage pattern is:
+//
+//   iter := IterateWords(vec, i, j)
+//   for iter.Next() {
+//     ... // call Index(), Word(), Mask(), and/or SetWord()
+//   }
+//   err := iter.Close()
+//
+type WordIterator interface {
+	// Next advances the iterator to the next word and returns true, or
+	// returns false if the end of the range has been reached or an error
+	// occurred.
+	Next() bool
+
+	// Index returns the index of the first bit of the current word.
+	Index() uint64
+
+	// Word returns the bits of the current word which lie within Mask.
+	Word() uint64
+
+	// Mask returns a mask of the bits of the current word which lie within
+	// the iterator's range.
+	Mask() uint64
+
+	// SetWord replaces the bits of the current word which lie within Mask.
+	SetWord(uint64)
+
+	// Err returns the error which caused Next to return false, if any.
+	Err() error
+
+	// Flush ensures that all pending writes have reached the OS.
+	Flush() error
+
+	// Close flushes any writes and frees the resources used by the iterator.
+	Close() error
+}
+
+// IterateWords returns a WordIterator over the bits with indices i through
+// j-1.
+func IterateWords(ba BigBitVector, i, j uint64) WordIterator {
+	if i > j {
+		panic(fmt.Errorf("IterateWords: i > j: i=%d j=%d", i, j))
+	}
+	if j > ba.Len() {
+		j = ba.Len()
+	}
+	if i > j {
+		i = j
+	}
+	return &wordIterator{
+		pc: newPageCursor(ba),
+		i:  i,
+		j:  j,
+		ro: ba.Frozen(),
+	}
+}
+
+type wordIterator struct {
+	pc     pageCursor
+	data   []byte
+	err    error
+	base   uint64
+	pos    uint64
+	i      uint64
+	j      uint64
+	word   uint64
+	mask   uint64
+	primed bool
+	done   bool
+	ro     bool
+}
+
+func (iter *wordIterator) Err() error { return iter.err }
+
+func (iter *wordIterator) Index() uint64 {
+	iter.check("Index")
+	return iter.pos
+}
+
+func (iter *wordIterator) Word() uint64 {
+	iter.check("Word")
+	return iter.word
+}
+
+func (iter *wordIterator) Mask() uint64 {
+	iter.check("Mask")
+	return iter.mask
+}
+
+func (iter *wordIterator) check(method string) {
+	if !iter.primed {
+		panic(fmt.Sprintf("must call Next() before %s()", method))
+	}
+	if iter.done {
+		panic(fmt.Sprintf("must not call %s() after Next() returns false", method))
+	}
+}
+
+func (iter *wordIterator) Next() bool {
+	if iter.err != nil || iter.done {
+		return false
+	}
+	if !iter.primed {
+		iter.pos = iter.i - iter.i%64
+		iter.primed = true
+	} else {
+		iter.pos += 64
+	}
+	if iter.pos >= iter.j {
+		iter.word = 0
+		iter.mask = 0
+		iter.done = true
+		return false
+	}
+
+	off := iter.pos / 8
+	if iter.data == nil || off < iter.base || off >= iter.base+uint64(len(iter.data)) {
+		base, data, err := iter.pc.load(off)
+		if err != nil {
+			iter.err = err
+			iter.done = true
+			return false
+		}
+		iter.base = base
+		iter.data = data
+	}
+
+	mask := ^uint64(0)
+	if iter.pos < iter.i {
+		mask <<= (iter.i - iter.pos)
+	}
+	if iter.pos+64 > iter.j {
+		mask &= ^uint64(0) >> (iter.pos + 64 - iter.j)
+	}
+	iter.mask = mask
+	iter.word = loadWord(iter.bytes()) & mask
+	return true
+}
+
+// bytes returns the (up to 8) loaded bytes of the current word.
+func (iter *wordIterator) bytes() []byte {
+	off := iter.pos/8 - iter.base
+	if off >= uint64(len(iter.data)) {
+		return nil
+	}
+	b := iter.data[off:]
+	if len(b) > 8 {
+		b = b[0:8]
+	}
+	return b
+}
+
+func (iter *wordIterator) SetWord(word uint64) {
+	iter.check("SetWord")
+	if iter.err != nil {
+		return
+	}
+	if iter.ro {
+		panic("BigBitVector is read-only")
+	}
+	iter.word = word & iter.mask
+	storeWord(iter.bytes(), iter.word, iter.mask)
+	iter.pc.markDirty()
+}
+
+func (iter *wordIterator) Flush() error {
+	if iter.pc == nil {
+		return nil
+	}
+	return iter.pc.flush()
+}
+
+func (iter *wordIterator) Close() error {
+	if iter.pc == nil {
+		return ErrClosedIterator
+	}
+	err := iter.pc.close()
+	if iter.err != nil {
+		err = iter.err
+	}
+	*iter = wordIterator{err: ErrClosedIterator}
+	return err
+}
+
+var _ WordIterator = (*wordIterator)(nil)
+
+// loadWord reads up to 8 little-endian bytes as a word.
+func loadWord(b []byte) uint64 {
+	if len(b) >= 8 {
+		return binary.LittleEndian.Uint64(b)
+	}
+	var w uint64
+	for k, x := range b {
+		w |= uint64(x) << (8 * uint(k))
+	}
+	return w
+}
+
+// storeWord replaces the bits of the up to 8 little-endian bytes in b which
+// are selected by mask.
+func storeWord(b []byte, word, mask uint64) {
+	if len(b) >= 8 {
+		old := binary.LittleEndian.Uint64(b)
+		binary.LittleEndian.PutUint64(b, (old & ^mask)|(word&mask))
+		return
+	}
+	for k := range b {
+		m := byte(mask >> (8 * uint(k)))
+		b[k] = (b[k] & ^m) | (byte(word>>(8*uint(k))) & m)
+	}
+}
+
+// ForEachPage calls fn with the packed bytes of the bitvector, one page at a
+// time, in order.  Bit i of the bitvector is bit (i%8) of byte (i/8), counting
+// from the least significant bit.  Bits past the end of the bitvector read as
+// zero.
+//
+// The pages are not copied where it can be avoided, so fn must not modify or
+// retain them.  In-memory bitvectors are presented as a single page.
+//
+func ForEachPage(ba BigBitVector, fn func(offset uint64, page []byte) error) error {
+	pc := newPageCursor(ba)
+	numBits := ba.Len()
+	numBytes := (numBits + 7) / 8
+
+	var tail []byte
+	for off := uint64(0); off < numBytes; {
+		base, data, err := pc.load(off)
+		if err != nil {
+			pc.close()
+			return err
+		}
+		if base+uint64(len(data)) > numBytes {
+			data = data[0 : numBytes-base]
+		}
+		if off-base >= uint64(len(data)) {
+			pc.close()
+			return fmt.Errorf("ForEachPage: short page at offset %d", off)
+		}
+		data = data[off-base:]
+
+		end := off + uint64(len(data))
+		if r := numBits % 8; end == numBytes && r != 0 && data[len(data)-1]>>r != 0 {
+			tail = append(tail[:0], data...)
+			tail[len(tail)-1] &= byte(1)<<r - 1
+			data = tail
+		}
+		if err := fn(off, data); err != nil {
+			pc.close()
+			return err
+		}
+		off = end
+	}
+	return pc.close()
+}
+
+// streamWords walks the bitvectors srcs, which must all have the same length,
+// 64 bits at a time and in step, reading each page of each source once.  At
+// every word position fn is called with the index of the word's first bit, the
+// mask of the bits inside the bitvectors, and the masked words of the sources.
+// If dst is not nil, the word returned by fn is stored into it.
+func streamWords(dst BigBitVector, srcs []BigBitVector, fn func(index, mask uint64, in []uint64) (uint64, error)) error {
+	return streamWordRange(dst, srcs, srcs[0].Len(), fn)
+}
+
+// errStopStream may be returned by the function passed to streamWordRange to
+// stop early without an error.
+var errStopStream = errors.New("stop streaming")
+
+// streamWordRange is streamWords over just the first num bits of each
+// bitvector, which may be longer.
+func streamWordRange(dst BigBitVector, srcs []BigBitVector, num uint64, fn func(index, mask uint64, in []uint64) (uint64, error)) error {
+	iters := make([]WordIterator, len(srcs))
+	for i, src := range srcs {
+		iters[i] = IterateWords(src, 0, num)
+	}
+	var out WordIterator
+	if dst != nil {
+		out = IterateWords(dst, 0, num)
+	}
+
+	in := make([]uint64, len(srcs))
+	var err error
+loop:
+	for {
+		for i, iter := range iters {
+			if !iter.Next() {
+				break loop
+			}
+			in[i] = iter.Word()
+		}
+		var word uint64
+		word, err = fn(iters[0].Index(), iters[0].Mask(), in)
+		if err != nil {
+			break
+		}
+		if out != nil {
+			if !out.Next() {
+				break
+			}
+			out.SetWord(word)
+		}
+	}
+
+	if err == errStopStream {
+		err = nil
+	}
+	for _, iter := range iters {
+		if err2 := iter.Close(); err == nil {
+			err = err2
+		}
+	}
+	if out != nil {
+		if err2 := out.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}